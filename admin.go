@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"log"
+)
+
+// Arten der Regeln, nach denen eine Person Administrator wird.
+const (
+	adminRuleLastName      = "lastname"
+	adminRuleGroup         = "group"
+	adminRuleAttribute     = "attribute"
+	adminRulePersonSyncKey = "personsynckey"
+)
+
+// UcsAdminRule legt fest, wann eine Person als Administrator übertragen wird.
+// Attribute wird nur bei RuleType attribute ausgewertet und benennt das UCS-Attribut in Data.
+// Ist School gesetzt, gilt die Regel nur für Mitglieder dieser Schule.
+type UcsAdminRule struct {
+	gorm.Model
+	RuleType  string
+	Attribute string
+	Value     string
+	School    string
+}
+
+// adminDesignation prüft alle Admin-Regeln und liefert den Grund der ersten passenden Regel.
+func adminDesignation(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) (bool, string) {
+	if !syncSetup.UCSSetupAdminSpecification {
+		return false, ""
+	}
+
+	// Sind die Schulen nicht lesbar, greifen nur Regeln ohne Schule.
+	schools := make(map[string]string)
+	err := json.Unmarshal([]byte(person.Schulmitgliedschaften), &schools)
+	if err != nil {
+		log.Println("Admin rules", person.Username, "Schulmitgliedschaften:", err)
+	}
+
+	for _, rule := range syncSetup.UCSSetupAdminRules {
+		if rule.School != "" {
+			if _, ok := schools[rule.School]; !ok {
+				continue
+			}
+		}
+		if matchAdminRule(rule, person) {
+			reason := "Regel " + rule.RuleType + " " + rule.Value
+			if rule.Attribute != "" {
+				reason = "Regel " + rule.RuleType + " " + rule.Attribute + "=" + rule.Value
+			}
+			if rule.School != "" {
+				reason = reason + " an Schule " + rule.School
+			}
+			return true, reason
+		}
+	}
+	return false, ""
+}
+
+func matchAdminRule(rule UcsAdminRule, person itswizard_basic.UniventionPerson) bool {
+	switch rule.RuleType {
+	case adminRuleLastName:
+		return person.LastName == rule.Value
+	case adminRulePersonSyncKey:
+		return person.PersonSyncKey == rule.Value
+	case adminRuleGroup:
+		groups := make(map[string]string)
+		err := json.Unmarshal([]byte(person.GruppenMitgliedschaften), &groups)
+		if err != nil {
+			log.Println("Admin rules", person.Username, "GruppenMitgliedschaften:", err)
+			return false
+		}
+		_, ok := groups[rule.Value]
+		return ok
+	case adminRuleAttribute:
+		for _, value := range ucsAttribute(person, rule.Attribute) {
+			if value == rule.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ucsAttribute liest ein Attribut aus dem UCS-Objekt in Data. Listen werden als mehrere Werte geliefert.
+func ucsAttribute(person itswizard_basic.UniventionPerson, attribute string) []string {
+	var data struct {
+		Object map[string]interface{} `json:"object"`
+	}
+	err := json.Unmarshal([]byte(person.Data), &data)
+	if err != nil || data.Object == nil {
+		return nil
+	}
+
+	var values []string
+	switch value := data.Object[attribute].(type) {
+	case string:
+		values = append(values, value)
+	case []interface{}:
+		for _, v := range value {
+			values = append(values, fmt.Sprint(v))
+		}
+	case nil:
+	default:
+		values = append(values, fmt.Sprint(value))
+	}
+	return values
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// protocolHistoryLimit ist die Anzahl der UcsProtokoll Einträge, die zu einer Person geliefert werden.
+const protocolHistoryLimit = 100
+
+type runState struct {
+	Running       bool      `json:"running"`
+	Kind          string    `json:"kind"`
+	InstitutionID uint      `json:"institution_id,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	LastError     string    `json:"last_error"`
+}
+
+// runStatus sorgt dafür, dass nur ein Lauf gleichzeitig im Prozess läuft.
+type runStatus struct {
+	mu    sync.Mutex
+	state runState
+}
+
+var currentStatus = &runStatus{}
+
+func (s *runStatus) start(kind string, institutionID uint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Running {
+		return false
+	}
+	s.state = runState{
+		Running:       true,
+		Kind:          kind,
+		InstitutionID: institutionID,
+		StartedAt:     time.Now(),
+		FinishedAt:    s.state.FinishedAt,
+	}
+	return true
+}
+
+func (s *runStatus) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Running = false
+	s.state.FinishedAt = time.Now()
+	s.state.LastError = ""
+	if err != nil {
+		s.state.LastError = err.Error()
+	}
+}
+
+func (s *runStatus) snapshot() runState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+type personStatus struct {
+	PersonSyncKey                 string                         `json:"person_sync_key"`
+	Username                      string                         `json:"username"`
+	ToImport                      bool                           `json:"to_import"`
+	ToUpdate                      bool                           `json:"to_update"`
+	ToDelete                      bool                           `json:"to_delete"`
+	Success                       bool                           `json:"success"`
+	Error                         bool                           `json:"error"`
+	Errorstring                   string                         `json:"errorstring"`
+	UpdateFirstName               bool                           `json:"update_first_name"`
+	UpdateLastName                bool                           `json:"update_last_name"`
+	UpdateUsername                bool                           `json:"update_username"`
+	UpdateProfile                 bool                           `json:"update_profile"`
+	UpdateEmail                   bool                           `json:"update_email"`
+	UpdateSchulmitgliedschaften   bool                           `json:"update_schulmitgliedschaften"`
+	UpdateGruppenMitgliedschaften bool                           `json:"update_gruppen_mitgliedschaften"`
+	UpdatedAt                     time.Time                      `json:"updated_at"`
+	Locked                        bool                           `json:"locked"`
+	Protocol                      []itswizard_basic.UcsProtokoll `json:"protocol"`
+}
+
+// serveAdminAPI stellt die Admin-API bereit, wenn CRAWLER_ADMIN_TOKEN gesetzt ist.
+// Jede Anfrage braucht den Header "Authorization: Bearer <token>".
+func serveAdminAPI(ctx context.Context, mux *http.ServeMux, allDatabases map[string]*gorm.DB) {
+	token := os.Getenv("CRAWLER_ADMIN_TOKEN")
+	if token == "" {
+		log.Println("CRAWLER_ADMIN_TOKEN is not set, admin API disabled")
+		return
+	}
+
+	mux.HandleFunc("/admin/status", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"run":          currentStatus.snapshot(),
+			"locked":       lockedUsers(),
+			"instance":     instanceID(),
+			"lease_mode":   leaseMode(),
+			"institutions": currentHeartbeat.institutions(),
+		})
+	}))
+
+	mux.HandleFunc("/admin/sync/institution", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		institutionID, err := institutionParam(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !currentStatus.start("institution", institutionID) {
+			writeError(w, http.StatusConflict, errors.New("a run is already in progress"))
+			return
+		}
+		go func() {
+			err := syncInstitution(ctx, allDatabases, institutionID)
+			if err != nil {
+				sendLog("Admin sync of institution " + strconv.Itoa(int(institutionID)) + ": " + err.Error())
+			}
+			currentStatus.finish(err)
+		}()
+		writeJSON(w, http.StatusAccepted, currentStatus.snapshot())
+	}))
+
+	mux.HandleFunc("/admin/sync/person", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+			return
+		}
+		setup, person, err := adminPerson(allDatabases, r)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		// Bricht der Aufrufer die Anfrage ab, läuft die Person trotzdem zu Ende.
+		out, err := syncPerson(ctx, setup, person)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": out})
+	}))
+
+	mux.HandleFunc("/admin/person", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		setup, person, err := adminPerson(allDatabases, r)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		status := personStatus{
+			PersonSyncKey:                 person.PersonSyncKey,
+			Username:                      person.Username,
+			ToImport:                      person.ToImport,
+			ToUpdate:                      person.ToUpdate,
+			ToDelete:                      person.ToDelete,
+			Success:                       person.Success,
+			Error:                         person.Error,
+			Errorstring:                   person.Errorstring,
+			UpdateFirstName:               person.UdpateFirstName,
+			UpdateLastName:                person.UdpateLastName,
+			UpdateUsername:                person.UdpateUsername,
+			UpdateProfile:                 person.UdpateProfile,
+			UpdateEmail:                   person.UpdateEmail,
+			UpdateSchulmitgliedschaften:   person.UpdateSchulmitgliedschaften,
+			UpdateGruppenMitgliedschaften: person.UpdateGruppenMitgliedschaften,
+			UpdatedAt:                     person.UpdatedAt,
+			Locked:                        isUserlocked(person.PersonSyncKey),
+		}
+		err = setup.db.Where("uuid = ?", person.PersonSyncKey).Order("id desc").Limit(protocolHistoryLimit).Find(&status.Protocol).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}))
+}
+
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func institutionParam(r *http.Request) (uint, error) {
+	institutionID, err := strconv.Atoi(r.URL.Query().Get("institution"))
+	if err != nil || institutionID <= 0 {
+		return 0, errors.New("parameter institution is missing")
+	}
+	return uint(institutionID), nil
+}
+
+// adminPerson liest die Person aus den Parametern institution und key (PersonSyncKey).
+func adminPerson(allDatabases map[string]*gorm.DB, r *http.Request) (ucsSyncSetup, itswizard_basic.UniventionPerson, error) {
+	var person itswizard_basic.UniventionPerson
+	institutionID, err := institutionParam(r)
+	if err != nil {
+		return ucsSyncSetup{}, person, err
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return ucsSyncSetup{}, person, errors.New("parameter key is missing")
+	}
+	setup, err := loadSyncSetup(allDatabases, institutionID)
+	if err != nil {
+		return setup, person, err
+	}
+	err = setup.db.Where("person_sync_key = ?", key).Last(&person).Error
+	if err != nil {
+		return setup, person, errors.Wrap(err, "person "+key)
+	}
+	return setup, person, nil
+}
+
+// loadSyncSetup liest die Einstellungen nur für die angefragte Institution.
+func loadSyncSetup(allDatabases map[string]*gorm.DB, institutionID uint) (ucsSyncSetup, error) {
+	var univentionService itswizard_basic.UniventionService
+	err := allDatabases["Client"].Where("insitution_id = ? and run_person_crawler = ?", institutionID, true).Last(&univentionService).Error
+	if err != nil {
+		if err.Error() == "record not found" {
+			return ucsSyncSetup{}, errors.New("institution " + strconv.Itoa(int(institutionID)) + " does not run the person crawler")
+		}
+		return ucsSyncSetup{}, err
+	}
+	return loadSyncSetupFor(allDatabases, univentionService)
+}
+
+// syncInstitution führt einen Lauf nur für eine Institution aus.
+func syncInstitution(ctx context.Context, allDatabases map[string]*gorm.DB, institutionID uint) error {
+	setup, err := loadSyncSetup(allDatabases, institutionID)
+	if err != nil {
+		return err
+	}
+	setups := map[uint]ucsSyncSetup{institutionID: setup}
+	leases, err := acquireLeases(allDatabases["Client"], setups)
+	if err != nil {
+		return err
+	}
+	defer leases.release()
+	if !leases.holds(institutionID) {
+		return errors.New("another instance holds the lease")
+	}
+	start := time.Now()
+	run := newRunReport(start)
+	runScheduler(withRunReport(ctx, run), setups, start, leases)
+	return run.save(allDatabases["Client"], time.Now())
+}
+
+// syncPerson überträgt eine Person sofort. Ohne offenen Import oder Löschung wird sie vollständig aktualisiert.
+// Wie syncInstitution läuft sie nur, wenn kein anderer Lauf im Prozess läuft und die Instanz die Sperre der Institution hält.
+// Sie hat die Frist einer Person im Lauf und wird beim Beenden des Daemons oder Verlust der Sperre als "interrupted, retry"
+// abgebrochen. Sie zählt in keinen Bericht eines Laufs.
+func syncPerson(ctx context.Context, setup ucsSyncSetup, person itswizard_basic.UniventionPerson) (out string, err error) {
+	if !currentStatus.start("person", setup.InstitutionID) {
+		return "", errors.New("a run is already in progress")
+	}
+	defer func() {
+		currentStatus.finish(err)
+	}()
+	leases, err := acquireLeases(setup.dbClient, map[uint]ucsSyncSetup{setup.InstitutionID: setup})
+	if err != nil {
+		return "", err
+	}
+	defer leases.release()
+	if !leases.holds(setup.InstitutionID) {
+		return "", errors.New("another instance holds the lease")
+	}
+	if !lockUser(person.PersonSyncKey) {
+		return "", errors.New("person " + person.PersonSyncKey + " is in process")
+	}
+	defer unlockUser(person.PersonSyncKey)
+
+	ctx, cancelLease := leases.context(ctx, setup.InstitutionID)
+	defer cancelLease()
+	ctx, cancel := context.WithTimeout(ctx, setup.CrawlerSetup.personTimeout())
+	defer cancel()
+	ctx = withRunID(ctx, "admin-"+uuid.New().String())
+
+	switch {
+	case person.ToDelete && !person.Success:
+		return ucsDeleteUser(ctx, setup, person, setup.InstitutionID), nil
+	case person.ToImport:
+		return ucsImportUser(ctx, setup, person, setup.InstitutionID), nil
+	}
+
+	person.ToUpdate = true
+	person.UdpateFirstName = true
+	person.UdpateLastName = true
+	person.UdpateUsername = true
+	person.UdpateProfile = true
+	person.UpdateEmail = true
+	person.UpdateSchulmitgliedschaften = true
+	person.UpdateGruppenMitgliedschaften = true
+	ch := make(chan string, 1)
+	ucsUpdateUser(ctx, setup, person, setup.InstitutionID, ch)
+	return <-ch, nil
+}
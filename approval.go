@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Arten der Freigaben.
+const (
+	approvalDelete = "delete" // Löschung einer Person in itslearning
+	approvalAdmin  = "admin"  // Profil Administrator durch eine Admin-Regel
+)
+
+// Status einer Freigabe.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+// UcsApproval ist eine Änderung, die erst nach der Freigabe durch einen Menschen ausgeführt wird.
+// Freigegebene und abgelehnte Einträge werden im nächsten Lauf umgesetzt.
+// Eine freigegebene Löschung gilt einmal, eine Freigabe als Administrator bleibt bestehen.
+type UcsApproval struct {
+	gorm.Model
+	PersonID      uint
+	PersonSyncKey string `gorm:"index"`
+	Username      string
+	Kind          string
+	Reason        string
+	RunID         string
+	Status        string
+	DecidedBy     string
+	DecidedAt     *time.Time
+	Done          bool // die freigegebene oder abgelehnte Löschung wurde umgesetzt
+}
+
+func latestApproval(db *gorm.DB, personSyncKey, kind string) (*UcsApproval, error) {
+	var approval UcsApproval
+	err := db.Where("person_sync_key = ? and kind = ?", personSyncKey, kind).Last(&approval).Error
+	if err != nil {
+		if err.Error() == "record not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &approval, nil
+}
+
+// requestApproval liefert die offene Freigabe einer Person. Gibt es keine, wird sie angelegt und gemeldet.
+func requestApproval(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, kind, reason string) (*UcsApproval, error) {
+	approval, err := latestApproval(syncSetup.db, person.PersonSyncKey, kind)
+	if err != nil {
+		return nil, err
+	}
+	if approval != nil && !approval.Done {
+		return approval, nil
+	}
+	approval = &UcsApproval{
+		PersonID:      person.ID,
+		PersonSyncKey: person.PersonSyncKey,
+		Username:      person.Username,
+		Kind:          kind,
+		Reason:        reason,
+		RunID:         runIDOf(ctx),
+		Status:        approvalPending,
+	}
+	err = syncSetup.Store.save(approval)
+	if err != nil {
+		return nil, err
+	}
+	sendLog("Approval needed for " + kind + " of person " + person.Username + " (" + person.PersonSyncKey + ") in institution " +
+		strconv.Itoa(int(syncSetup.InstitutionID)) + ": 'ucs_crawler approvals approve -institution " +
+		strconv.Itoa(int(syncSetup.InstitutionID)) + " -id " + strconv.Itoa(int(approval.ID)) + " -by <name>'")
+	return approval, nil
+}
+
+// finishApproval vermerkt, dass die Entscheidung umgesetzt wurde.
+func finishApproval(syncSetup ucsSyncSetup, approval *UcsApproval) {
+	approval.Done = true
+	syncSetup.Store.save(approval)
+}
+
+// withdrawApproval schließt eine offene Freigabe der Löschung, wenn die Person wieder in UCS vorhanden ist.
+func withdrawApproval(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) {
+	approval, err := latestApproval(syncSetup.db, person.PersonSyncKey, approvalDelete)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if approval != nil && !approval.Done {
+		finishApproval(syncSetup, approval)
+	}
+}
+
+// adminApproved prüft, ob eine Person mit passender Admin-Regel Administrator werden darf.
+// Ohne Freigabe wird sie mit ihrem normalen Profil übertragen.
+func adminApproved(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) bool {
+	approval, err := latestApproval(syncSetup.db, person.PersonSyncKey, approvalAdmin)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return approval != nil && approval.Status == approvalApproved
+}
+
+// requestAdminApproval legt eine Person mit passender Admin-Regel zur Freigabe vor, falls noch nicht geschehen.
+func requestAdminApproval(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, reason string) {
+	approval, err := requestApproval(ctx, syncSetup, person, approvalAdmin, reason)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if approval.Status != approvalApproved {
+		log.Println("Person", person.Username, "wird ohne Freigabe nicht Administrator:", approval.Status)
+	}
+}
+
+// excludePendingApprovals nimmt Personen, deren Löschung auf eine Freigabe wartet, aus der Löschphase.
+func excludePendingApprovals(query *gorm.DB, setup UniventionCrawlerSetup) *gorm.DB {
+	if !setup.ApproveDeletes {
+		return query
+	}
+	return query.Where("person_sync_key not in (select person_sync_key from ucs_approvals "+
+		"where deleted_at is null and kind = ? and status = ? and done = 0)", approvalDelete, approvalPending)
+}
+
+// approvalsCommand zeigt und entscheidet die Freigaben:
+// ucs_crawler approvals list [-institution id] [-all]
+// ucs_crawler approvals approve|reject -institution id -id n -by name
+func approvalsCommand(allDatabases map[string]*gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: approvals list|approve|reject")
+	}
+	flags := flag.NewFlagSet("approvals", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "institution")
+	approvalID := flags.Uint("id", 0, "approval")
+	by := flags.String("by", "", "who decides")
+	all := flags.Bool("all", false, "also show decided approvals")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		for id, db := range allDatabases {
+			if id == "Client" || db == nil || (*institutionID != 0 && id != strconv.Itoa(int(*institutionID))) {
+				continue
+			}
+			if !db.HasTable(&UcsApproval{}) {
+				continue
+			}
+			query := db.Order("id")
+			if !*all {
+				query = query.Where("status = ? and done = ?", approvalPending, false)
+			}
+			var approvals []UcsApproval
+			err := query.Find(&approvals).Error
+			if err != nil {
+				return err
+			}
+			for _, approval := range approvals {
+				fmt.Printf("institution %s #%d %s %s %s (%s) %s: %s %s\n", id, approval.ID, approval.CreatedAt.Format(time.RFC3339),
+					approval.Kind, approval.Username, approval.PersonSyncKey, approval.Status, approval.DecidedBy, approval.Reason)
+			}
+		}
+		return nil
+	case "approve", "reject":
+		db := allDatabases[strconv.Itoa(int(*institutionID))]
+		if *institutionID == 0 || db == nil {
+			return errors.New("unknown institution " + strconv.Itoa(int(*institutionID)))
+		}
+		if *by == "" {
+			return errors.New("parameter by is missing")
+		}
+		var approval UcsApproval
+		err := db.Where("id = ?", *approvalID).First(&approval).Error
+		if err != nil {
+			return errors.Wrap(err, "approval "+strconv.Itoa(int(*approvalID)))
+		}
+		if approval.Status != approvalPending || approval.Done {
+			return errors.New("approval " + strconv.Itoa(int(approval.ID)) + " is already " + approval.Status)
+		}
+		return decideApproval(db, approval, args[0] == "approve", *by)
+	}
+	return errors.New("unknown approvals command " + args[0])
+}
+
+// decideApproval speichert die Entscheidung im UcsProtokoll und markiert die Person für den nächsten Lauf.
+func decideApproval(db *gorm.DB, approval UcsApproval, approve bool, by string) error {
+	now := time.Now()
+	approval.Status = approvalRejected
+	if approve {
+		approval.Status = approvalApproved
+	}
+	approval.DecidedBy = by
+	approval.DecidedAt = &now
+	err := db.Save(&approval).Error
+	if err != nil {
+		return err
+	}
+
+	action := "Freigabe"
+	if !approve {
+		action = "Ablehnung"
+	}
+	if approval.Kind == approvalAdmin {
+		action = action + " Administrator"
+	} else {
+		action = action + " Benutzerlöschung"
+	}
+	err = db.Save(&itswizard_basic.UcsProtokoll{
+		Username:    approval.Username,
+		UUID:        approval.PersonSyncKey,
+		Action:      action + " durch " + by,
+		Success:     true,
+		Errorstring: "",
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// Die Löschung wartet mit to_delete auf die Entscheidung, ein neuer Administrator braucht ein Update des Profils.
+	if approval.Kind == approvalAdmin && approve {
+		err = db.Model(&itswizard_basic.UniventionPerson{}).
+			Where("id = ? and to_import = 0 and to_delete = 0", approval.PersonID).
+			Updates(map[string]interface{}{
+				"to_update":      true,
+				"error":          false,
+				"udpate_profile": true,
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Approval", approval.ID, approval.Kind, approval.Username, approval.Status, "by", by)
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// UcsAuditEntry beschreibt, was der Crawler für eine Person an itslearning gesendet hat und warum.
+// Zu jedem Eintrag im UcsProtokoll gibt es einen UcsAuditEntry mit den Einzelheiten.
+type UcsAuditEntry struct {
+	gorm.Model
+	RunID              string `gorm:"index"` // gleiche ID für alle Einträge eines Laufs
+	PersonSyncKey      string `gorm:"index"`
+	Username           string
+	Action             string // import, update, delete
+	Event              string // succeeded, skipped, failed, removed, present, interrupted
+	FromState          string
+	ToState            string
+	Success            bool
+	Errorstring        string `sql:"type:text"`
+	Previous           string `sql:"type:text"` // JSON der zuletzt gesendeten Werte
+	Sent               string `sql:"type:text"` // JSON der gesendeten Werte
+	MembershipsAdded   string `sql:"type:text"` // JSON Liste "gruppe:rolle"
+	MembershipsRemoved string `sql:"type:text"` // JSON Liste "gruppe:rolle", soweit sie der Crawler angelegt hat
+	Trigger            string `sql:"type:text"` // JSON Liste der geänderten Spalten, die die Bearbeitung ausgelöst haben
+	TriggerAt          time.Time
+}
+
+// UcsMembershipState sind die Mitgliedschaften "gruppe:rolle", die der Crawler zurzeit für eine Person in itslearning hält.
+// Der Stand wird mit jedem Audit-Eintrag fortgeschrieben und bleibt erhalten, wenn die Aufbewahrungsfrist das Audit leert.
+type UcsMembershipState struct {
+	gorm.Model
+	PersonSyncKey string `gorm:"unique_index"`
+	Memberships   string `sql:"type:text"` // JSON Liste "gruppe:rolle"
+}
+
+// auditBatchSize ist die Anzahl der Audit-Einträge, die beim Anlegen von UcsMembershipState auf einmal gelesen werden.
+const auditBatchSize = 500
+
+// auditValues sind die vorbereiteten Werte, wie sie an itslearning gehen. Leere Werte wurden nicht gesendet.
+type auditValues struct {
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Profile   string `json:"profile,omitempty"`
+	Email     string `json:"email,omitempty"`
+}
+
+// auditTrail sammelt während der Bearbeitung einer Person, was gesendet wurde.
+type auditTrail struct {
+	sent      auditValues
+	added     []string
+	removed   []string
+	abandoned string // schreibender Aufruf, auf dessen Ergebnis nach einem Abbruch nicht mehr gewartet wurde
+}
+
+type runIDKey struct{}
+type auditTrailKey struct{}
+
+func withRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+func runIDOf(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// startAudit legt den auditTrail für eine Person an. transitionPerson schreibt ihn mit dem Ergebnis.
+func startAudit(ctx context.Context) (context.Context, *auditTrail) {
+	trail := &auditTrail{}
+	return context.WithValue(ctx, auditTrailKey{}, trail), trail
+}
+
+func auditTrailOf(ctx context.Context) *auditTrail {
+	trail, _ := ctx.Value(auditTrailKey{}).(*auditTrail)
+	return trail
+}
+
+func (t *auditTrail) addMembership(group, role string) {
+	t.added = append(t.added, group+":"+role)
+}
+
+func (t *auditTrail) removeMemberships(memberships []string) {
+	t.removed = append(t.removed, memberships...)
+}
+
+// currentMemberships sind die Mitgliedschaften "gruppe:rolle", die der Crawler zurzeit für die Person hält.
+func currentMemberships(db *gorm.DB, personSyncKey string) ([]string, error) {
+	var state UcsMembershipState
+	err := db.Where("person_sync_key = ?", personSyncKey).First(&state).Error
+	if err != nil {
+		if err.Error() == "record not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return state.memberships()
+}
+
+func (s UcsMembershipState) memberships() ([]string, error) {
+	if s.Memberships == "" {
+		return nil, nil
+	}
+	var memberships []string
+	err := json.Unmarshal([]byte(s.Memberships), &memberships)
+	return memberships, err
+}
+
+// saveAuditEntry speichert den Audit-Eintrag und schreibt in derselben Transaktion die Mitgliedschaften der Person fort.
+func saveAuditEntry(db *gorm.DB, entry *UcsAuditEntry) error {
+	return withRetry(func() error {
+		row := *entry
+		tx := db.Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+		err := tx.Save(&row).Error
+		if err == nil {
+			err = applyMembershipState(tx, row)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit().Error
+		if err == nil {
+			*entry = row
+		}
+		return err
+	})
+}
+
+// applyMembershipState schreibt den Stand der Mitgliedschaften einer Person mit einem Audit-Eintrag fort.
+func applyMembershipState(db *gorm.DB, entry UcsAuditEntry) error {
+	var state UcsMembershipState
+	err := db.Where("person_sync_key = ?", entry.PersonSyncKey).First(&state).Error
+	if err != nil && err.Error() != "record not found" {
+		return err
+	}
+	memberships, err := state.memberships()
+	if err != nil {
+		return err
+	}
+	memberships, err = applyAuditEntry(memberships, entry)
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(memberships)
+	state.PersonSyncKey = entry.PersonSyncKey
+	state.Memberships = string(b)
+	return db.Save(&state).Error
+}
+
+// backfillMembershipStates legt UcsMembershipState einmal aus den Audit-Einträgen an, die vor der Tabelle geschrieben wurden.
+func backfillMembershipStates(db *gorm.DB) error {
+	count := 0
+	err := db.Model(&UcsMembershipState{}).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	memberships := make(map[string][]string)
+	lastID := uint(0)
+	for {
+		var entries []UcsAuditEntry
+		err := db.Select("id, person_sync_key, to_state, memberships_added, memberships_removed").
+			Where("id > ?", lastID).Order("id").Limit(auditBatchSize).Find(&entries).Error
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			lastID = entry.ID
+			memberships[entry.PersonSyncKey], err = applyAuditEntry(memberships[entry.PersonSyncKey], entry)
+			if err != nil {
+				return errors.Wrap(err, "audit entry "+strconv.Itoa(int(entry.ID)))
+			}
+		}
+	}
+	if len(memberships) == 0 {
+		return nil
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for personSyncKey, list := range memberships {
+		b, _ := json.Marshal(list)
+		err = tx.Create(&UcsMembershipState{PersonSyncKey: personSyncKey, Memberships: string(b)}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// applyAuditEntry schreibt die Mitgliedschaften einer Person mit dem nächsten Audit-Eintrag fort.
+// removeMemberships löscht immer alle Mitgliedschaften, mit entfernten Mitgliedschaften oder der Löschung beginnt die Liste neu.
+func applyAuditEntry(memberships []string, entry UcsAuditEntry) ([]string, error) {
+	if entry.ToState == string(stateDeleted) {
+		return nil, nil
+	}
+	if entry.MembershipsRemoved != "" && entry.MembershipsRemoved != "null" && entry.MembershipsRemoved != "[]" {
+		memberships = nil
+	}
+	if entry.MembershipsAdded == "" {
+		return memberships, nil
+	}
+	var added []string
+	err := json.Unmarshal([]byte(entry.MembershipsAdded), &added)
+	if err != nil {
+		return memberships, err
+	}
+	return append(memberships, added...), nil
+}
+
+// triggerOf sind die Spalten, deren Änderung in UCS die Bearbeitung ausgelöst hat. Die Werte stehen nicht im Audit.
+func triggerOf(person itswizard_basic.UniventionPerson) []string {
+	var fields []string
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"to_import", person.ToImport},
+		{"to_delete", person.ToDelete},
+		{"first_name", person.UdpateFirstName},
+		{"last_name", person.UdpateLastName},
+		{"username", person.UdpateUsername},
+		{"profile", person.UdpateProfile},
+		{"email", person.UpdateEmail},
+		{"schulmitgliedschaften", person.UpdateSchulmitgliedschaften},
+		{"gruppen_mitgliedschaften", person.UpdateGruppenMitgliedschaften},
+		{"stammschule", person.UpdateStammschule},
+		{"disable", person.UpdateDisable},
+	} {
+		if field.set {
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+// previousValues sind die Werte, die zuletzt erfolgreich für die Person gesendet wurden.
+func previousValues(db *gorm.DB, personSyncKey string) string {
+	var entries []UcsAuditEntry
+	err := db.Where("person_sync_key = ? and success = ? and sent <> '' and sent <> '{}'", personSyncKey, true).
+		Order("id desc").Limit(1).Find(&entries).Error
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Sent
+}
+
+// saveAudit schreibt den auditTrail der Person. Ohne auditTrail im Kontext wird nichts geschrieben.
+func saveAudit(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, from, to personSyncState, event string, success bool, err error) {
+	trail := auditTrailOf(ctx)
+	if trail == nil {
+		return
+	}
+	sent, _ := json.Marshal(trail.sent)
+	added, _ := json.Marshal(trail.added)
+	removed, _ := json.Marshal(trail.removed)
+	trigger, _ := json.Marshal(triggerOf(person))
+	entry := UcsAuditEntry{
+		RunID:              runIDOf(ctx),
+		PersonSyncKey:      person.PersonSyncKey,
+		Username:           person.Username,
+		Action:             phaseOf(from),
+		Event:              event,
+		FromState:          string(from),
+		ToState:            string(to),
+		Success:            success,
+		Previous:           previousValues(syncSetup.db, person.PersonSyncKey),
+		Sent:               string(sent),
+		MembershipsAdded:   string(added),
+		MembershipsRemoved: string(removed),
+		Trigger:            string(trigger),
+		TriggerAt:          person.UpdatedAt,
+	}
+	if err != nil {
+		entry.Errorstring = err.Error()
+	}
+	syncSetup.Store.saveAudit(entry)
+}
+
+// auditCommand zeigt die Audit-Einträge einer Institution:
+// ucs_crawler audit -institution id [-person key] [-run id] [-since 24h|2006-01-02T15:04:05Z] [-until ...] [-limit n]
+func auditCommand(allDatabases map[string]*gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "institution")
+	person := flags.String("person", "", "PersonSyncKey or username")
+	runID := flags.String("run", "", "run correlation ID")
+	since := flags.String("since", "", "start of the time window, RFC3339 or a duration like 24h")
+	until := flags.String("until", "", "end of the time window, RFC3339 or a duration like 1h")
+	limit := flags.Int("limit", 100, "number of entries")
+	flags.Parse(args)
+
+	db := allDatabases[strconv.Itoa(int(*institutionID))]
+	if *institutionID == 0 || db == nil {
+		return errors.New("unknown institution " + strconv.Itoa(int(*institutionID)))
+	}
+	query := db.Order("id desc").Limit(*limit)
+	if *person != "" {
+		query = query.Where("person_sync_key = ? or username = ?", *person, *person)
+	}
+	if *runID != "" {
+		query = query.Where("run_id = ?", *runID)
+	}
+	if *since != "" {
+		t, err := parseTimeFlag(*since)
+		if err != nil {
+			return errors.Wrap(err, "since")
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if *until != "" {
+		t, err := parseTimeFlag(*until)
+		if err != nil {
+			return errors.Wrap(err, "until")
+		}
+		query = query.Where("created_at <= ?", t)
+	}
+
+	var entries []UcsAuditEntry
+	err := query.Find(&entries).Error
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s run=%s %s (%s) %s %s: %s -> %s success=%t %s\n",
+			entry.CreatedAt.Format(time.RFC3339), entry.RunID, entry.Username, entry.PersonSyncKey,
+			entry.Action, entry.Event, entry.FromState, entry.ToState, entry.Success, entry.Errorstring)
+		fmt.Printf("    previous: %s\n    sent:     %s\n    added:    %s\n    removed:  %s\n    trigger (%s): %s\n",
+			entry.Previous, entry.Sent, entry.MembershipsAdded, entry.MembershipsRemoved,
+			entry.TriggerAt.Format(time.RFC3339), entry.Trigger)
+	}
+	if len(entries) == 0 {
+		log.Println("No audit entries found")
+	}
+	return nil
+}
+
+// parseTimeFlag liest einen Zeitpunkt oder eine Dauer vor jetzt.
+func parseTimeFlag(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func auditValuesOf(person itswizard_basic.DbPerson15) auditValues {
+	return auditValues{
+		FirstName: person.FirstName,
+		LastName:  person.LastName,
+		Username:  person.Username,
+		Profile:   person.Profile,
+		Email:     person.Email,
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// brakeAlertPersons ist die Anzahl der Personen, die im Alarm namentlich genannt werden.
+const brakeAlertPersons = 50
+
+// UcsDeleteBrake hält die Löschungen einer Institution an, weil zu viele Personen auf einmal gelöscht werden sollten.
+// Erst nach der Freigabe mit "ucs_crawler brake release" werden die angehaltenen Löschungen ausgeführt.
+type UcsDeleteBrake struct {
+	gorm.Model
+	RunID      string
+	Pending    int // Löschungen beim letzten Lauf
+	Active     int // aktive Personen beim letzten Lauf
+	Limit      int // erlaubte Löschungen je Lauf
+	Released   bool
+	ReleasedBy string
+	ReleasedAt *time.Time
+	Consumed   bool // alle freigegebenen Löschungen wurden ausgeführt
+}
+
+// UcsDeleteHold ist eine Person, deren Löschung durch eine Bremse angehalten ist.
+type UcsDeleteHold struct {
+	gorm.Model
+	UcsDeleteBrakeID uint `gorm:"index"`
+	PersonID         uint
+	PersonSyncKey    string
+	Username         string
+}
+
+// deleteLimit ist die kleinere der beiden Schwellen. 0 bedeutet keine Bremse.
+func deleteLimit(setup UniventionCrawlerSetup, active int) int {
+	limit := 0
+	if setup.DeleteBrakeCount > 0 {
+		limit = setup.DeleteBrakeCount
+	}
+	if setup.DeleteBrakePercent > 0 {
+		percentLimit := active * setup.DeleteBrakePercent / 100
+		if percentLimit < 1 {
+			percentLimit = 1
+		}
+		if limit == 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	return limit
+}
+
+// releasedHolds sind die Personen freigegebener Bremsen, deren Löschungen noch nicht alle ausgeführt wurden.
+const releasedHolds = "select person_sync_key from ucs_delete_holds where deleted_at is null and ucs_delete_brake_id in " +
+	"(select id from ucs_delete_brakes where deleted_at is null and released = 1 and consumed = 0)"
+
+// openSoftDeletes sind die Personen in der Quarantäne.
+const openSoftDeletes = "select person_sync_key from ucs_soft_deletes where deleted_at is null and restored = 0 and deleted = 0"
+
+// onlyReleasedDeletions lässt bei angezogener Bremse nur freigegebene Personen und Personen in Quarantäne in die Löschphase.
+func onlyReleasedDeletions(query *gorm.DB) *gorm.DB {
+	return query.Where("(person_sync_key in (" + releasedHolds + ") or person_sync_key in (" + openSoftDeletes + "))")
+}
+
+// checkDeleteBrake zählt die offenen Löschungen vor dem Lauf. Liegen sie über der Schwelle, werden sie angehalten,
+// es wird ein Alarm gesendet und true geliefert. Die Löschphase bearbeitet dann nur noch onlyReleasedDeletions.
+// Freigegebene Personen zählen nicht mit, bis alle gelöscht sind, auch wenn DeleteQuota sie auf mehrere Läufe verteilt.
+// Personen in Quarantäne wurden beim Deaktivieren gezählt und werden nach der Schonfrist nicht noch einmal gezählt.
+// Können die Löschungen nicht gezählt werden, wird ein Fehler geliefert und die ganze Löschphase angehalten.
+func checkDeleteBrake(ctx context.Context, syncSetup ucsSyncSetup, runStart time.Time) (bool, error) {
+	if syncSetup.CrawlerSetup.DeleteBrakeCount <= 0 && syncSetup.CrawlerSetup.DeleteBrakePercent <= 0 {
+		return false, nil
+	}
+	db := syncSetup.db
+	institution := strconv.Itoa(int(syncSetup.InstitutionID))
+
+	pendingQuery := db.Model(&itswizard_basic.UniventionPerson{}).
+		Where(phaseQueries[phaseDelete]+" and data <> '' and updated_at < ?", runStart.Truncate(time.Second))
+	pendingQuery = excludePendingApprovals(pendingQuery, syncSetup.CrawlerSetup).
+		Where("person_sync_key not in (" + openSoftDeletes + ")")
+	releasedQuery := pendingQuery.Where("person_sync_key in (" + releasedHolds + ")")
+	pendingQuery = pendingQuery.Where("person_sync_key not in (" + releasedHolds + ")")
+	var pending, released, active int
+	err := pendingQuery.Count(&pending).Error
+	if err == nil {
+		err = releasedQuery.Count(&released).Error
+	}
+	if err == nil {
+		err = db.Model(&itswizard_basic.UniventionPerson{}).Where("not (to_delete = 1 and success = 1)").Count(&active).Error
+	}
+	if err != nil {
+		sendLog("Error while checking delete brake of institution " + institution + ": " + err.Error() + " Hold deletions")
+		log.Println(err)
+		return true, err
+	}
+
+	if released == 0 {
+		err = db.Model(&UcsDeleteBrake{}).Where("released = ? and consumed = ?", true, false).Update("consumed", true).Error
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	limit := deleteLimit(syncSetup.CrawlerSetup, active)
+	if pending <= limit {
+		return false, nil
+	}
+
+	var persons []itswizard_basic.UniventionPerson
+	err = pendingQuery.Select("id, person_sync_key, username").Find(&persons).Error
+	if err != nil {
+		log.Println(err)
+	}
+	isNew, err := holdDeletions(db, runIDOf(ctx), pending, active, limit, persons)
+	if err != nil {
+		sendLog("Error while saving UcsDeleteBrake of institution " + institution + ": " + err.Error())
+		log.Println(err)
+	}
+	if isNew {
+		var names []string
+		for i := 0; i < len(persons) && i < brakeAlertPersons; i++ {
+			names = append(names, persons[i].Username+" ("+persons[i].PersonSyncKey+")")
+		}
+		sendLog("ALERT: delete brake for institution " + institution + ": " + strconv.Itoa(pending) + " deletions of " +
+			strconv.Itoa(active) + " active persons, limit " + strconv.Itoa(limit) + ". Deletions are held until " +
+			"'ucs_crawler brake release -institution " + institution + " -by <name>'. Released deletions and persons in " +
+			"quarantine continue. Held: " + strings.Join(names, ", "))
+	} else {
+		log.Println("Deletions of institution", institution, "are still held:", pending)
+	}
+	return true, nil
+}
+
+// holdDeletions schreibt die Bremse mit den angehaltenen Personen. Eine offene Bremse wird aktualisiert,
+// damit nur beim ersten Anhalten ein Alarm gesendet wird.
+func holdDeletions(db *gorm.DB, runID string, pending, active, limit int, persons []itswizard_basic.UniventionPerson) (bool, error) {
+	var brake UcsDeleteBrake
+	err := db.Where("released = ?", false).Last(&brake).Error
+	if err != nil && err.Error() != "record not found" {
+		return false, err
+	}
+	isNew := brake.ID == 0
+	brake.RunID = runID
+	brake.Pending = pending
+	brake.Active = active
+	brake.Limit = limit
+	err = db.Save(&brake).Error
+	if err != nil {
+		return isNew, err
+	}
+
+	err = db.Unscoped().Where("ucs_delete_brake_id = ?", brake.ID).Delete(&UcsDeleteHold{}).Error
+	if err != nil {
+		return isNew, err
+	}
+	for _, person := range persons {
+		err = db.Save(&UcsDeleteHold{
+			UcsDeleteBrakeID: brake.ID,
+			PersonID:         person.ID,
+			PersonSyncKey:    person.PersonSyncKey,
+			Username:         person.Username,
+		}).Error
+		if err != nil {
+			return isNew, err
+		}
+	}
+	return isNew, nil
+}
+
+// brakeCommand zeigt und löst die Löschbremse:
+// ucs_crawler brake list [-institution id]
+// ucs_crawler brake release -institution id -by name
+func brakeCommand(allDatabases map[string]*gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: brake list|release")
+	}
+	flags := flag.NewFlagSet("brake", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "institution")
+	by := flags.String("by", "", "who releases the deletions")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		for id, db := range allDatabases {
+			if id == "Client" || db == nil || (*institutionID != 0 && id != strconv.Itoa(int(*institutionID))) {
+				continue
+			}
+			if !db.HasTable(&UcsDeleteBrake{}) {
+				continue
+			}
+			var brakes []UcsDeleteBrake
+			err := db.Where("released = ?", false).Find(&brakes).Error
+			if err != nil {
+				return err
+			}
+			for _, brake := range brakes {
+				fmt.Printf("institution %s: held since %s, %d deletions of %d active persons, limit %d\n",
+					id, brake.CreatedAt.Format(time.RFC3339), brake.Pending, brake.Active, brake.Limit)
+				var holds []UcsDeleteHold
+				err = db.Where("ucs_delete_brake_id = ?", brake.ID).Find(&holds).Error
+				if err != nil {
+					return err
+				}
+				for _, hold := range holds {
+					fmt.Printf("    %s (%s)\n", hold.Username, hold.PersonSyncKey)
+				}
+			}
+		}
+		return nil
+	case "release":
+		db := allDatabases[strconv.Itoa(int(*institutionID))]
+		if *institutionID == 0 || db == nil {
+			return errors.New("unknown institution " + strconv.Itoa(int(*institutionID)))
+		}
+		if *by == "" {
+			return errors.New("parameter by is missing")
+		}
+		var brake UcsDeleteBrake
+		err := db.Where("released = ?", false).Last(&brake).Error
+		if err != nil {
+			return errors.Wrap(err, "no held deletions")
+		}
+		now := time.Now()
+		brake.Released = true
+		brake.ReleasedBy = *by
+		brake.ReleasedAt = &now
+		err = db.Save(&brake).Error
+		if err != nil {
+			return err
+		}
+		sendLog("Delete brake of institution " + strconv.Itoa(int(*institutionID)) + " released by " + *by + ": " + strconv.Itoa(brake.Pending) + " deletions")
+		return nil
+	}
+	return errors.New("unknown brake command " + args[0])
+}
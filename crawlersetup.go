@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	defaultCallTimeout   = time.Minute
+	defaultPersonTimeout = 10 * time.Minute
+)
+
+// UniventionCrawlerSetup enthält die Einstellungen des Crawlers für eine Institution.
+// Fehlt der Eintrag, gelten die Standardwerte.
+type UniventionCrawlerSetup struct {
+	gorm.Model
+	SchoolParentSyncID    string // Übergeordnete Gruppe der Schulen, leer: oberste Ebene
+	StripSchoolPrefix     bool   // "schule-5a" wird in itslearning zu "5a"
+	PrefillGroupCache     bool   // Vorhandene Gruppen zu Beginn des Laufs einzeln und parallel auslesen
+	Priority              int    // Seiten je Runde im Vergleich zu anderen Institutionen, Standard 1
+	PhaseOrder            string // z.B. "delete,import,update", Standard "import,delete,update"
+	PageSize              int    // Personen je Seite, Standard 50
+	ImportQuota           int    // Höchstzahl je Lauf, 0: Standard, -1: unbegrenzt
+	DeleteQuota           int
+	UpdateQuota           int
+	CallTimeoutSeconds    int    // Höchstdauer eines IMS-ES Aufrufs, Standard 60
+	PersonTimeoutSeconds  int    // Höchstdauer für eine Person mit allen Aufrufen, Standard 600
+	RetentionDays         int    // Aufbewahrung von Protokoll, Audit und anderen Daten gelöschter Personen, 0: unbegrenzt
+	RetentionMode         string // "pseudonymise" (Standard) oder "purge"
+	DeleteBrakeCount      int    // Löschungen je Lauf, ab denen angehalten wird, 0: aus
+	DeleteBrakePercent    int    // Löschungen in Prozent der aktiven Personen, ab denen angehalten wird, 0: aus
+	DeleteGraceDays       int    // Tage in der Quarantänegruppe vor der Löschung, 0: sofort löschen
+	QuarantineGroupSyncID string // Gruppe für Personen in der Schonfrist, Standard "ucs-quarantine"
+	ApproveDeletes        bool   // Löschungen erst nach Freigabe mit "ucs_crawler approvals approve"
+	ApproveAdmins         bool   // Profil Administrator durch Admin-Regeln erst nach Freigabe
+	ReconcileIntervalDays int    // Tage zwischen zwei vollständigen Abgleichen mit itslearning, 0: aus
+	GroupCleanupDays      int    // Tage ohne Mitglieder aus UCS, bis eine angelegte Gruppe archiviert wird, 0: aus
+	GroupArchiveSyncID    string // Gruppe für archivierte Gruppen, Standard "ucs-archive"
+	PrimaryProfilePolicy  string // Profil bei mehreren Schulen: "ucs" (Standard), "highest" oder "first"
+}
+
+func (s UniventionCrawlerSetup) callTimeout() time.Duration {
+	if s.CallTimeoutSeconds > 0 {
+		return time.Duration(s.CallTimeoutSeconds) * time.Second
+	}
+	return defaultCallTimeout
+}
+
+func (s UniventionCrawlerSetup) personTimeout() time.Duration {
+	if s.PersonTimeoutSeconds > 0 {
+		return time.Duration(s.PersonTimeoutSeconds) * time.Second
+	}
+	return defaultPersonTimeout
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/itslearninggermany/itswizard_basic"
+	"log"
+	"sync"
+)
+
+// prefillWorkers ist die Anzahl paralleler ReadGroup Aufrufe beim Vorbefüllen.
+const prefillWorkers = 10
+
+// groupCache merkt sich je Institution und Lauf, welche Gruppen in itslearning existieren.
+// Gleichzeitige Anfragen für dieselbe Gruppe warten auf den ersten Aufruf, statt selbst anzulegen.
+type groupCache struct {
+	mu      sync.Mutex
+	exists  map[string]bool
+	pending map[string]*groupCall
+}
+
+type groupCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newGroupCache() *groupCache {
+	return &groupCache{
+		exists:  make(map[string]bool),
+		pending: make(map[string]*groupCall),
+	}
+}
+
+// ensure ruft create für eine Gruppe höchstens einmal gleichzeitig auf. Nach Erfolg gilt die Gruppe als vorhanden.
+// Wer auf einen anderen Aufruf wartet, hört mit dem Ende seines Kontexts auf zu warten.
+func (c *groupCache) ensure(ctx context.Context, syncID string, create func() error) error {
+	c.mu.Lock()
+	if c.exists[syncID] {
+		c.mu.Unlock()
+		return nil
+	}
+	if call, ok := c.pending[syncID]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &groupCall{done: make(chan struct{})}
+	c.pending[syncID] = call
+	c.mu.Unlock()
+
+	call.err = create()
+
+	c.mu.Lock()
+	if call.err == nil {
+		c.exists[syncID] = true
+	}
+	delete(c.pending, syncID)
+	c.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (c *groupCache) markExisting(syncID string) {
+	c.mu.Lock()
+	c.exists[syncID] = true
+	c.mu.Unlock()
+}
+
+// prefillGroupCache liest die Ebenen der Hierarchie und alle Schulen und Gruppen der offenen Personen parallel aus itslearning.
+// IMS-ES bietet kein Auslesen der ganzen Hierarchie auf einmal, jede Gruppe braucht einen eigenen ReadGroup Aufruf.
+// Das Vorbefüllen spart deshalb keine Aufrufe, es zieht sie nur an den Anfang des Laufs und verteilt sie auf prefillWorkers.
+func prefillGroupCache(ctx context.Context, syncSetup ucsSyncSetup) {
+	var persons []itswizard_basic.UniventionPerson
+	err := syncSetup.db.Select("username, schulmitgliedschaften, gruppen_mitgliedschaften").Where("(to_import = 1 or to_update = 1) and error = 0").Find(&persons).Error
+	if err != nil {
+		log.Println("Prefill group cache:", err)
+		return
+	}
+
+	groups := make(map[string]bool)
+	for syncID := range syncSetup.Hierarchy.nodes {
+		groups[syncID] = true
+	}
+	for _, person := range persons {
+		schools := make(map[string]string)
+		err := json.Unmarshal([]byte(person.Schulmitgliedschaften), &schools)
+		if err != nil {
+			log.Println("Prefill group cache", person.Username, err)
+		}
+		for school := range schools {
+			groups[school] = true
+		}
+		memberships := make(map[string]string)
+		err = json.Unmarshal([]byte(person.GruppenMitgliedschaften), &memberships)
+		if err != nil {
+			log.Println("Prefill group cache", person.Username, err)
+		}
+		for group := range memberships {
+			groups[group] = true
+		}
+	}
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < prefillWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				name, err := syncSetup.itsl.ReadGroupName(ctx, id)
+				if err == nil && name != "" {
+					syncSetup.Groups.markExisting(id)
+				}
+			}
+		}()
+	}
+	for id := range groups {
+		if ctx.Err() != nil {
+			break
+		}
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+	log.Println("Group cache prefilled with", len(groups), "groups")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Aktionen und Vergleichsarten der Gruppenfilter.
+const (
+	groupFilterInclude = "include"
+	groupFilterExclude = "exclude"
+
+	groupMatchSubstring = "substring"
+	groupMatchExact     = "exact"
+	groupMatchGlob      = "glob"
+	groupMatchRegex     = "regex"
+)
+
+// Gruppentypen in UCS@school.
+const (
+	groupTypeClass     = "class"
+	groupTypeWorkgroup = "workgroup"
+)
+
+// defaultClassPattern erkennt Klassen wie "schule-5a" oder "schule-10b", wenn kein Muster hinterlegt ist.
+const defaultClassPattern = `^[^-]+-\d{1,2}[^-]*$`
+
+// UcsGroupFilterRule filtert die Gruppenmitgliedschaften einer Person.
+// Leere Felder Profile, GroupType und School gelten für alle.
+// Gibt es für eine Gruppe passende include-Regeln, wird sie nur übertragen, wenn eine davon zutrifft.
+// Trifft eine exclude-Regel zu, wird die Gruppe nie übertragen.
+type UcsGroupFilterRule struct {
+	gorm.Model
+	Profile   string
+	Action    string
+	MatchType string
+	Pattern   string
+	GroupType string
+	School    string
+}
+
+// UcsGroupTypePattern erkennt den Gruppentyp an einem regulären Ausdruck auf den Gruppennamen.
+type UcsGroupTypePattern struct {
+	gorm.Model
+	GroupType string
+	Pattern   string
+}
+
+type groupFilterRule struct {
+	UcsGroupFilterRule
+	match func(group string) bool
+}
+
+type groupTypePattern struct {
+	groupType string
+	pattern   *regexp.Regexp
+}
+
+type groupFilter struct {
+	rules        []groupFilterRule
+	typePatterns []groupTypePattern
+}
+
+// newGroupFilter übersetzt die Regeln. Die alten UcsTeacherGroupName werden zu include-Regeln für Staff.
+func newGroupFilter(rules []UcsGroupFilterRule, typePatterns []UcsGroupTypePattern, teacherGroupNames []itswizard_basic.UcsTeacherGroupName) (groupFilter, error) {
+	var filter groupFilter
+
+	for _, teacherGroupName := range teacherGroupNames {
+		rules = append(rules, UcsGroupFilterRule{
+			Profile:   "Staff",
+			Action:    groupFilterInclude,
+			MatchType: groupMatchSubstring,
+			Pattern:   teacherGroupName.Name,
+		})
+	}
+
+	for _, rule := range rules {
+		if rule.Action != groupFilterInclude && rule.Action != groupFilterExclude {
+			return filter, errors.New("unknown group filter action " + rule.Action)
+		}
+		match, err := groupMatcher(rule.MatchType, rule.Pattern)
+		if err != nil {
+			return filter, err
+		}
+		filter.rules = append(filter.rules, groupFilterRule{UcsGroupFilterRule: rule, match: match})
+	}
+
+	if len(typePatterns) == 0 {
+		typePatterns = append(typePatterns, UcsGroupTypePattern{GroupType: groupTypeClass, Pattern: defaultClassPattern})
+	}
+	for _, typePattern := range typePatterns {
+		re, err := regexp.Compile(typePattern.Pattern)
+		if err != nil {
+			return filter, errors.Wrap(err, "group type pattern "+typePattern.Pattern)
+		}
+		filter.typePatterns = append(filter.typePatterns, groupTypePattern{groupType: typePattern.GroupType, pattern: re})
+	}
+
+	return filter, nil
+}
+
+func groupMatcher(matchType, pattern string) (func(group string) bool, error) {
+	switch matchType {
+	case groupMatchSubstring, "":
+		return func(group string) bool { return strings.Contains(group, pattern) }, nil
+	case groupMatchExact:
+		return func(group string) bool { return group == pattern }, nil
+	case groupMatchGlob:
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "group filter glob "+pattern)
+		}
+		return func(group string) bool {
+			ok, _ := path.Match(pattern, group)
+			return ok
+		}, nil
+	case groupMatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "group filter regex "+pattern)
+		}
+		return re.MatchString, nil
+	}
+	return nil, errors.New("unknown group filter match type " + matchType)
+}
+
+// groupType liefert class oder workgroup. Gruppen ohne passendes Muster sind Arbeitsgruppen.
+func (f groupFilter) groupType(group string) string {
+	for _, typePattern := range f.typePatterns {
+		if typePattern.pattern.MatchString(group) {
+			return typePattern.groupType
+		}
+	}
+	return groupTypeWorkgroup
+}
+
+func (f groupFilter) isGroupToImport(profile, group, school string) bool {
+	groupType := f.groupType(group)
+	hasInclude := false
+	included := false
+	for _, rule := range f.rules {
+		if rule.Profile != "" && rule.Profile != profile {
+			continue
+		}
+		if rule.GroupType != "" && rule.GroupType != groupType {
+			continue
+		}
+		if rule.School != "" && rule.School != school {
+			continue
+		}
+		if rule.Action == groupFilterExclude {
+			if rule.match(group) {
+				return false
+			}
+			continue
+		}
+		hasInclude = true
+		if rule.match(group) {
+			included = true
+		}
+	}
+	return !hasInclude || included
+}
+
+// getGruppenmitgliedschaften liefert Gruppe -> Schule für alle Gruppen, die übertragen werden.
+func getGruppenmitgliedschaften(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles) (gruppenmitgliedschaften map[string]string, err error) {
+	gruppenmitgliedschaften = make(map[string]string)
+	err = json.Unmarshal([]byte(person.GruppenMitgliedschaften), &gruppenmitgliedschaften)
+	if err != nil {
+		return nil, err
+	}
+
+	for group, school := range gruppenmitgliedschaften {
+		if !syncSetup.GroupFilter.isGroupToImport(schoolProfile(syncSetup, person, roles, school), group, school) {
+			delete(gruppenmitgliedschaften, group)
+		}
+	}
+	return gruppenmitgliedschaften, nil
+}
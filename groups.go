@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultArchiveGroup = "ucs-archive"
+	groupCleanupBatch   = 500
+)
+
+// createdGroupKind ist die Art der angelegten Gruppen.
+const createdGroupKind = "group"
+
+// UcsCreatedGroup ist eine Gruppe, die der Crawler in itslearning angelegt hat.
+// Nur diese Gruppen werden archiviert, von Hand angelegte Gruppen bleiben unberührt.
+type UcsCreatedGroup struct {
+	gorm.Model
+	SyncID       string `gorm:"index"`
+	Name         string
+	ParentSyncID string
+	Level        int
+	Kind         string
+	UnusedSince  *time.Time // seitdem in keiner GruppenMitgliedschaft einer Person aus UCS
+	Archived     bool
+}
+
+func (s UniventionCrawlerSetup) archiveGroup() string {
+	if s.GroupArchiveSyncID != "" {
+		return s.GroupArchiveSyncID
+	}
+	return defaultArchiveGroup
+}
+
+// registerCreatedGroup merkt sich eine angelegte Gruppe. Wird eine archivierte Gruppe wieder angelegt, gilt sie wieder als aktiv.
+func registerCreatedGroup(syncSetup ucsSyncSetup, group itswizard_basic.DbGroup15, kind string) {
+	var created UcsCreatedGroup
+	err := syncSetup.db.Where("sync_id = ?", group.SyncID).Last(&created).Error
+	if err != nil && err.Error() != "record not found" {
+		log.Println(err)
+		return
+	}
+	created.SyncID = group.SyncID
+	created.Name = group.Name
+	created.ParentSyncID = group.ParentGroupID
+	created.Level = group.Level
+	created.Kind = kind
+	created.UnusedSince = nil
+	created.Archived = false
+	syncSetup.Store.save(&created)
+}
+
+// groupsInUse sind alle Gruppen aus den GruppenMitgliedschaften der Personen, die nicht gelöscht werden.
+// Ist eine Person nicht lesbar, wird abgebrochen, sonst würden ihre Gruppen als ungenutzt gelten.
+func groupsInUse(syncSetup ucsSyncSetup) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	lastID := uint(0)
+	for {
+		var persons []itswizard_basic.UniventionPerson
+		err := syncSetup.db.Where("id > ? and to_delete = 0 and data <> ''", lastID).Order("id").Limit(groupCleanupBatch).Find(&persons).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(persons) == 0 {
+			return inUse, nil
+		}
+		for _, person := range persons {
+			lastID = person.ID
+			groups, err := getGruppenmitgliedschaften(syncSetup, person, readSchoolRoles(syncSetup, person))
+			if err != nil {
+				return nil, errors.Wrap(err, "GruppenMitgliedschaften of "+person.Username)
+			}
+			for group := range groups {
+				inUse[group] = true
+			}
+		}
+	}
+}
+
+// groupsWithMemberships sind die Gruppen, in denen der Crawler laut UcsMembershipState noch Mitgliedschaften in itslearning hält,
+// auch für Personen in Quarantäne oder mit fehlgeschlagener Löschung.
+// IMS-ES liefert keine Mitglieder einer Gruppe und zu einer Person nur die IDs ihrer Mitgliedschaften.
+// Von Hand in itslearning angelegte Mitgliedschaften sind deshalb nicht bekannt.
+func groupsWithMemberships(db *gorm.DB) (map[string]bool, error) {
+	groups := make(map[string]bool)
+	lastID := uint(0)
+	for {
+		var states []UcsMembershipState
+		err := db.Where("id > ?", lastID).Order("id").Limit(groupCleanupBatch).Find(&states).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(states) == 0 {
+			return groups, nil
+		}
+		for _, state := range states {
+			lastID = state.ID
+			memberships, err := state.memberships()
+			if err != nil {
+				return nil, errors.Wrap(err, "memberships of "+state.PersonSyncKey)
+			}
+			for _, membership := range memberships {
+				if i := strings.LastIndex(membership, ":"); i > 0 {
+					groups[membership[:i]] = true
+				}
+			}
+		}
+	}
+}
+
+// cleanupGroups archiviert angelegte Gruppen, die seit GroupCleanupDays nicht mehr genutzt werden.
+// Ungenutzt ist eine Gruppe, die keine Person aus UCS mehr hat und in der es keine Mitgliedschaften mehr gibt.
+// Archivierte Gruppen, die wieder genutzt werden, kommen an ihren alten Platz zurück. Geliefert wird,
+// was getan wurde oder im Probelauf getan würde.
+func cleanupGroups(ctx context.Context, syncSetup ucsSyncSetup, dryRun bool) ([]string, error) {
+	delay := time.Duration(syncSetup.CrawlerSetup.GroupCleanupDays) * 24 * time.Hour
+	inUse, err := groupsInUse(syncSetup)
+	if err != nil {
+		return nil, err
+	}
+	withMemberships, err := groupsWithMemberships(syncSetup.db)
+	if err != nil {
+		return nil, err
+	}
+	var groups []UcsCreatedGroup
+	err = syncSetup.db.Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []string
+	now := time.Now()
+	for i := range groups {
+		if ctx.Err() != nil {
+			return actions, ctx.Err()
+		}
+		group := &groups[i]
+		if inUse[group.SyncID] {
+			if group.Archived {
+				actions = append(actions, "restore "+group.SyncID)
+				if !dryRun {
+					err = moveGroup(ctx, syncSetup, group, group.ParentSyncID, group.Level)
+					if err != nil {
+						return actions, errors.Wrap(err, "restore "+group.SyncID)
+					}
+				}
+			}
+			if group.UnusedSince != nil || group.Archived {
+				group.UnusedSince = nil
+				group.Archived = false
+				if !dryRun {
+					syncSetup.Store.save(group)
+				}
+			}
+			continue
+		}
+		if group.Archived {
+			continue
+		}
+		if withMemberships[group.SyncID] {
+			if dryRun {
+				actions = append(actions, "unused "+group.SyncID+", still has memberships")
+			}
+			continue
+		}
+
+		if group.UnusedSince == nil {
+			group.UnusedSince = &now
+			if !dryRun {
+				syncSetup.Store.save(group)
+			}
+		}
+		due := group.UnusedSince.Add(delay)
+		if now.Before(due) {
+			if dryRun {
+				actions = append(actions, "unused "+group.SyncID+", archive after "+due.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		actions = append(actions, "archive "+group.SyncID)
+		if dryRun {
+			continue
+		}
+		archive := syncSetup.CrawlerSetup.archiveGroup()
+		err = checkIfHierarchyNodeExist(ctx, syncSetup, archive)
+		if err != nil {
+			return actions, errors.Wrap(err, "archive "+group.SyncID)
+		}
+		err = moveGroup(ctx, syncSetup, group, archive, syncSetup.Hierarchy.level(archive)+1)
+		if err != nil {
+			return actions, errors.Wrap(err, "archive "+group.SyncID)
+		}
+		group.Archived = true
+		syncSetup.Store.save(group)
+	}
+	return actions, nil
+}
+
+// moveGroup legt die Gruppe mit derselben SyncID unter einer anderen übergeordneten Gruppe an.
+// Ob itslearning dabei Mitgliedschaften übernimmt, ist über IMS-ES nicht zugesichert. Archiviert werden deshalb nur
+// Gruppen ohne Mitgliedschaften, und nach der Wiederherstellung legen die Updates der Personen ihre Mitgliedschaften neu an.
+func moveGroup(ctx context.Context, syncSetup ucsSyncSetup, group *UcsCreatedGroup, parent string, level int) error {
+	dbGroup := itswizard_basic.DbGroup15{
+		SyncID:        group.SyncID,
+		Name:          group.Name,
+		ParentGroupID: parent,
+		Level:         level,
+	}
+	resp, err := syncSetup.itsl.CreateGroup(ctx, dbGroup, false)
+	if err != nil {
+		return errors.New(resp)
+	}
+	return nil
+}
+
+// runGroupCleanup ist der Aufruf im Lauf, das Ergebnis wird gemeldet.
+func runGroupCleanup(ctx context.Context, syncSetup ucsSyncSetup) {
+	institution := strconv.Itoa(int(syncSetup.InstitutionID))
+	actions, err := cleanupGroups(ctx, syncSetup, false)
+	if len(actions) > 0 {
+		sendLog("Group cleanup institution " + institution + ": " + strings.Join(actions, ", "))
+	}
+	if err != nil {
+		sendLog("Error while cleaning up groups of institution " + institution + ": " + err.Error())
+		log.Println(err)
+	}
+}
+
+// groupsCommand zeigt und bereinigt die angelegten Gruppen:
+// ucs_crawler groups list [-institution id]
+// ucs_crawler groups cleanup [-institution id] [-dry-run]
+func groupsCommand(ctx context.Context, allDatabases map[string]*gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: groups list|cleanup")
+	}
+	flags := flag.NewFlagSet("groups", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "only this institution")
+	dryRun := flags.Bool("dry-run", false, "only list what would be done")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		for id, db := range allDatabases {
+			if id == "Client" || db == nil || (*institutionID != 0 && id != strconv.Itoa(int(*institutionID))) {
+				continue
+			}
+			if !db.HasTable(&UcsCreatedGroup{}) {
+				continue
+			}
+			var groups []UcsCreatedGroup
+			err := db.Order("sync_id").Find(&groups).Error
+			if err != nil {
+				return err
+			}
+			for _, group := range groups {
+				unused := ""
+				if group.UnusedSince != nil {
+					unused = " unused since " + group.UnusedSince.Format(time.RFC3339)
+				}
+				fmt.Printf("institution %s: %s %s (%s) parent=%s archived=%t%s\n",
+					id, group.Kind, group.SyncID, group.Name, group.ParentSyncID, group.Archived, unused)
+			}
+		}
+		return nil
+	case "cleanup":
+		err := migrateClientDatabase(allDatabases["Client"])
+		if err != nil {
+			return err
+		}
+		ucsSyncSetupMap, err := loadSyncSetups(allDatabases)
+		if err != nil {
+			return err
+		}
+		for id, syncSetup := range ucsSyncSetupMap {
+			if *institutionID != 0 && id != *institutionID {
+				continue
+			}
+			if syncSetup.CrawlerSetup.GroupCleanupDays <= 0 {
+				fmt.Printf("institution %d: no group cleanup configured\n", id)
+				continue
+			}
+			actions, err := cleanupWithLease(ctx, allDatabases, id, syncSetup, *dryRun)
+			for _, action := range actions {
+				fmt.Printf("institution %d: %s\n", id, action)
+			}
+			if err != nil {
+				return errors.Wrap(err, "institution "+strconv.Itoa(int(id)))
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown groups command " + args[0])
+}
+
+// cleanupWithLease bereinigt die Gruppen einer Institution unter ihrer Sperre, damit kein Lauf gleichzeitig Gruppen anlegt.
+func cleanupWithLease(ctx context.Context, allDatabases map[string]*gorm.DB, institutionID uint, syncSetup ucsSyncSetup, dryRun bool) ([]string, error) {
+	leases, err := acquireLeases(allDatabases["Client"], map[uint]ucsSyncSetup{institutionID: syncSetup})
+	if err != nil {
+		return nil, err
+	}
+	defer leases.release()
+	if !leases.holds(institutionID) {
+		return nil, errors.New("another instance holds the lease")
+	}
+	ctx, cancel := leases.context(ctx, institutionID)
+	defer cancel()
+	return cleanupGroups(ctx, syncSetup, dryRun)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceName       = "UCSPersonCrawler"
+	heartbeatInterval = 30 * time.Second
+)
+
+// Phasen im RunningService außerhalb der Import-, Lösch- und Updatephase.
+const (
+	heartbeatStarting = "starting"
+	heartbeatIdle     = "idle"
+)
+
+// RunningService ist der Heartbeat einer Crawler-Instanz in der Client Datenbank.
+// Ein Watchdog erkennt an LastHeartbeat hängende und an LastError fehlerhafte Crawler.
+type RunningService struct {
+	gorm.Model
+	ServiceName   string
+	LastRun       string
+	InstanceID    string
+	Hostname      string
+	LastStart     *time.Time
+	LastSuccess   *time.Time
+	LastHeartbeat *time.Time
+	Phase         string
+	InstitutionID uint
+	LastError     string `sql:"type:text"`
+	Institutions  string `sql:"type:text"` // Institutionen, die der Instanz im Modus split gehören
+}
+
+type heartbeat struct {
+	mu      sync.Mutex
+	db      *gorm.DB
+	service RunningService
+}
+
+// currentHeartbeat wird beim ersten Lauf angelegt und schreibt bis zum Ende des Prozesses.
+var currentHeartbeat *heartbeat
+
+// instanceID ist CRAWLER_INSTANCE_ID oder der Hostname.
+func instanceID() string {
+	if id := os.Getenv("CRAWLER_INSTANCE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// startHeartbeat liest den Eintrag der Instanz oder legt ihn an.
+// Den alten Eintrag ohne InstanceID übernimmt genau eine Instanz mit einem bedingten Update.
+func startHeartbeat(dbClient *gorm.DB) (*heartbeat, error) {
+	h := &heartbeat{db: dbClient}
+	id := instanceID()
+	host, _ := os.Hostname()
+	err := dbClient.Where("service_name = ? and instance_id = ?", serviceName, id).First(&h.service).Error
+	if err != nil {
+		if err.Error() != "record not found" {
+			return nil, err
+		}
+		table := dbClient.NewScope(&RunningService{}).TableName()
+		result := dbClient.Exec("UPDATE "+table+" SET instance_id = ? WHERE service_name = ? and (instance_id = '' or instance_id is null) and deleted_at is null LIMIT 1",
+			id, serviceName)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			err = dbClient.Where("service_name = ? and instance_id = ?", serviceName, id).First(&h.service).Error
+		} else {
+			h.service = RunningService{ServiceName: serviceName, InstanceID: id, Hostname: host}
+			err = dbClient.Create(&h.service).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.service.Hostname = host
+
+	go func() {
+		for range time.Tick(heartbeatInterval) {
+			h.mu.Lock()
+			err := h.save()
+			h.mu.Unlock()
+			if err != nil {
+				log.Println("Heartbeat:", err)
+			}
+		}
+	}()
+	return h, nil
+}
+
+// save muss mit gesperrtem mu aufgerufen werden.
+func (h *heartbeat) save() error {
+	now := time.Now()
+	h.service.LastHeartbeat = &now
+	return h.db.Save(&h.service).Error
+}
+
+func (h *heartbeat) runStarted() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.service.LastStart = &now
+	h.service.LastRun = now.String()
+	h.service.Phase = heartbeatStarting
+	h.service.InstitutionID = 0
+	return h.save()
+}
+
+// setPhase meldet, welche Phase für welche Institution gerade läuft.
+func (h *heartbeat) setPhase(phase string, institutionID uint) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.service.Phase == phase && h.service.InstitutionID == institutionID {
+		return
+	}
+	h.service.Phase = phase
+	h.service.InstitutionID = institutionID
+	err := h.save()
+	if err != nil {
+		log.Println("Heartbeat:", err)
+	}
+}
+
+// setInstitutions meldet, welche Institutionen die Instanz bearbeitet.
+func (h *heartbeat) setInstitutions(institutionIDs []uint) {
+	if h == nil {
+		return
+	}
+	var ids []string
+	for _, institutionID := range institutionIDs {
+		ids = append(ids, strconv.Itoa(int(institutionID)))
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.service.Institutions = strings.Join(ids, ",")
+	err := h.save()
+	if err != nil {
+		log.Println("Heartbeat:", err)
+	}
+}
+
+func (h *heartbeat) institutions() string {
+	if h == nil {
+		return ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.service.Institutions
+}
+
+func (h *heartbeat) runFinished(runErr error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.service.Phase = heartbeatIdle
+	h.service.InstitutionID = 0
+	if runErr != nil {
+		h.service.LastError = runErr.Error()
+	} else {
+		now := time.Now()
+		h.service.LastSuccess = &now
+		h.service.LastError = ""
+	}
+	err := h.save()
+	if err != nil {
+		log.Println("Heartbeat:", err)
+	}
+}
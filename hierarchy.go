@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// rootGroupID ist die oberste Ebene in itslearning.
+const rootGroupID = "0"
+
+// UcsHierarchyNode beschreibt eine Ebene oberhalb der Klassen, z.B. Standort, Bezirk oder Schule.
+// Ein Knoten mit SyncID = Schulname legt Name und übergeordnete Gruppe dieser Schule fest.
+type UcsHierarchyNode struct {
+	gorm.Model
+	SyncID       string
+	Name         string
+	ParentSyncID string
+}
+
+type hierarchy struct {
+	nodes        map[string]UcsHierarchyNode
+	schoolParent string
+}
+
+func newHierarchy(nodes []UcsHierarchyNode, schoolParent string) hierarchy {
+	h := hierarchy{
+		nodes:        make(map[string]UcsHierarchyNode),
+		schoolParent: schoolParent,
+	}
+	if h.schoolParent == "" {
+		h.schoolParent = rootGroupID
+	}
+	for _, node := range nodes {
+		h.nodes[node.SyncID] = node
+	}
+	return h
+}
+
+func (h hierarchy) name(syncID string) string {
+	if node, ok := h.nodes[syncID]; ok && node.Name != "" {
+		return node.Name
+	}
+	return syncID
+}
+
+// parent liefert die übergeordnete Gruppe eines Knotens oder einer Schule.
+func (h hierarchy) parent(syncID string) string {
+	if node, ok := h.nodes[syncID]; ok {
+		if node.ParentSyncID == "" {
+			return rootGroupID
+		}
+		return node.ParentSyncID
+	}
+	if syncID == h.schoolParent {
+		return rootGroupID
+	}
+	return h.schoolParent
+}
+
+// level zählt die Ebenen bis zur obersten Ebene.
+func (h hierarchy) level(syncID string) int {
+	level := 0
+	for parent := h.parent(syncID); parent != rootGroupID; parent = h.parent(parent) {
+		level++
+		if level > len(h.nodes)+1 {
+			break
+		}
+	}
+	return level
+}
+
+// groupName ist der lesbare Name einer Gruppe ohne das Schulpräfix aus UCS.
+func groupName(syncSetup ucsSyncSetup, group, school string) string {
+	if syncSetup.CrawlerSetup.StripSchoolPrefix && strings.HasPrefix(group, school+"-") && len(group) > len(school)+1 {
+		return strings.TrimPrefix(group, school+"-")
+	}
+	return group
+}
+
+// checkIfHierarchyNodeExist legt eine Ebene und alle darüber liegenden Ebenen von oben nach unten an.
+func checkIfHierarchyNodeExist(ctx context.Context, syncSetup ucsSyncSetup, syncID string) error {
+	var path []string
+	for id := syncID; id != rootGroupID; id = syncSetup.Hierarchy.parent(id) {
+		if len(path) > len(syncSetup.Hierarchy.nodes)+1 {
+			return errors.New("hierarchy cycle at " + syncID)
+		}
+		path = append(path, id)
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		id := path[i]
+		err := syncSetup.Groups.ensure(ctx, id, func() error {
+			name, err := syncSetup.itsl.ReadGroupName(ctx, id)
+			if err != nil {
+				return err
+			}
+			if name != "" {
+				return nil
+			}
+			resp, err := syncSetup.itsl.CreateGroup(ctx, itswizard_basic.DbGroup15{
+				SyncID:        id,
+				Name:          syncSetup.Hierarchy.name(id),
+				ParentGroupID: syncSetup.Hierarchy.parent(id),
+				Level:         syncSetup.Hierarchy.level(id),
+			}, true)
+			if err != nil {
+				return errors.New(resp)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/itslearninggermany/imses"
+	"github.com/itslearninggermany/itswizard_basic"
+	"time"
+)
+
+// itslClient misst alle IMS-ES Aufrufe an itslearning und begrenzt ihre Dauer.
+// Ein abgelaufener Aufruf läuft im Hintergrund weiter, aber niemand wartet mehr auf ihn.
+// IMS-ES kennt keinen Kontext, ein schreibender Aufruf kann deshalb nach dem Abbruch noch ausgeführt werden.
+type itslClient struct {
+	*imses.Request
+	timeout time.Duration
+}
+
+type imsesResult[T any] struct {
+	value T
+	err   error
+}
+
+// callImses führt f mit der Frist des Aufrufs und des Kontexts aus.
+func callImses[T any](ctx context.Context, c *itslClient, method string, f func() (T, error)) (T, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	done := make(chan imsesResult[T], 1)
+	go func() {
+		value, err := f()
+		done <- imsesResult[T]{value, err}
+	}()
+
+	select {
+	case result := <-done:
+		observeImsesCall(method, start, result.err)
+		return result.value, result.err
+	case <-ctx.Done():
+		observeImsesCall(method, start, ctx.Err())
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// call ist für alle schreibenden Aufrufe, die die Antwort als Text liefern. Bei Abbruch steht der Grund in der Antwort
+// und der Aufruf wird im auditTrail vermerkt, damit die Person nicht als "interrupted, retry" wiederholt wird.
+func (c *itslClient) call(ctx context.Context, method string, f func() (string, error)) (string, error) {
+	resp, err := callImses(ctx, c, method, f)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		if trail := auditTrailOf(ctx); trail != nil {
+			trail.abandoned = method
+		}
+	}
+	if err != nil && resp == "" {
+		resp = method + ": " + err.Error()
+	}
+	return resp, err
+}
+
+// read ist für lesende Aufrufe ohne Fehlerrückgabe.
+func read[A, T any](ctx context.Context, c *itslClient, method string, f func(A) T, arg A) (T, error) {
+	return callImses(ctx, c, method, func() (T, error) {
+		return f(arg), nil
+	})
+}
+
+func (c *itslClient) CreatePerson(ctx context.Context, person itswizard_basic.DbPerson15) (string, error) {
+	return c.call(ctx, "CreatePerson", func() (string, error) { return c.Request.CreatePerson(person) })
+}
+
+func (c *itslClient) DeletePerson(ctx context.Context, personSyncKey string) (string, error) {
+	return c.call(ctx, "DeletePerson", func() (string, error) { return c.Request.DeletePerson(personSyncKey) })
+}
+
+func (c *itslClient) UpdateFirstName(ctx context.Context, personSyncKey, firstName string) (string, error) {
+	return c.call(ctx, "UpdateFirstName", func() (string, error) { return c.Request.UpdateFirstName(personSyncKey, firstName) })
+}
+
+func (c *itslClient) UpdateLastName(ctx context.Context, personSyncKey, lastName string) (string, error) {
+	return c.call(ctx, "UpdateLastName", func() (string, error) { return c.Request.UpdateLastName(personSyncKey, lastName) })
+}
+
+func (c *itslClient) UpdateUsername(ctx context.Context, personSyncKey, username string) (string, error) {
+	return c.call(ctx, "UpdateUsername", func() (string, error) { return c.Request.UpdateUsername(personSyncKey, username) })
+}
+
+func (c *itslClient) UpdateEmail(ctx context.Context, personSyncKey, email string) (string, error) {
+	return c.call(ctx, "UpdateEmail", func() (string, error) { return c.Request.UpdateEmail(personSyncKey, email) })
+}
+
+func (c *itslClient) CreateMembership(ctx context.Context, groupID, personSyncKey, role string) (string, error) {
+	return c.call(ctx, "CreateMembership", func() (string, error) { return c.Request.CreateMembership(groupID, personSyncKey, role) })
+}
+
+func (c *itslClient) CreateGroup(ctx context.Context, group itswizard_basic.DbGroup15, isSchool bool) (string, error) {
+	return c.call(ctx, "CreateGroup", func() (string, error) { return c.Request.CreateGroup(group, isSchool) })
+}
+
+// ReadGroupName liefert den Namen der Gruppe in itslearning, leer wenn es sie nicht gibt.
+func (c *itslClient) ReadGroupName(ctx context.Context, syncID string) (string, error) {
+	group, err := read(ctx, c, "ReadGroup", c.Request.ReadGroup, syncID)
+	if err != nil {
+		return "", err
+	}
+	return group.Group.Name, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/jinzhu/gorm"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Betriebsarten aus CRAWLER_LEASE_MODE.
+const (
+	leaseModeSingle = "single" // nur eine Instanz synchronisiert
+	leaseModeSplit  = "split"  // mehrere Instanzen teilen sich die Institutionen
+)
+
+const leaseDuration = 2 * time.Minute
+
+// CrawlerLease ist eine zeitlich begrenzte Sperre in der Client Datenbank.
+// Holder darf synchronisieren, bis ExpiresAt abgelaufen ist oder er die Sperre freigibt.
+type CrawlerLease struct {
+	gorm.Model
+	Name      string `gorm:"unique_index"`
+	Holder    string
+	ExpiresAt time.Time
+}
+
+// leaseHolder ist der Halter der Sperren dieses Prozesses. PID und Zufallswert trennen mehrere Prozesse
+// auf einem Host oder mit derselben CRAWLER_INSTANCE_ID, die Instanz steht nur zur Anzeige davor.
+var leaseHolder = newLeaseHolder()
+
+func newLeaseHolder() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return instanceID() + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(suffix)
+}
+
+func institutionLeaseName(institutionID uint) string {
+	return serviceName + "-" + strconv.Itoa(int(institutionID))
+}
+
+func leaseMode() string {
+	if os.Getenv("CRAWLER_LEASE_MODE") == leaseModeSplit {
+		return leaseModeSplit
+	}
+	return leaseModeSingle
+}
+
+// acquireLease übernimmt eine freie oder abgelaufene Sperre oder verlängert die eigene.
+// Die Zeit kommt aus der Datenbank, damit die Uhren der Instanzen keine Rolle spielen.
+func acquireLease(db *gorm.DB, name, holder string) (bool, error) {
+	var lease CrawlerLease
+	err := db.Where("name = ?", name).First(&lease).Error
+	if err != nil {
+		if err.Error() != "record not found" {
+			return false, err
+		}
+		// Legt eine andere Instanz die Sperre gleichzeitig an, schlägt dies am unique index fehl.
+		db.Create(&CrawlerLease{Name: name, ExpiresAt: time.Unix(0, 0)})
+	}
+
+	result := db.Model(&CrawlerLease{}).
+		Where("name = ? and (holder = ? or expires_at < NOW())", name, holder).
+		Updates(map[string]interface{}{
+			"holder":     holder,
+			"expires_at": gorm.Expr("NOW() + INTERVAL ? SECOND", int(leaseDuration.Seconds())),
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+func releaseLease(db *gorm.DB, name, holder string) error {
+	return db.Model(&CrawlerLease{}).
+		Where("name = ? and holder = ?", name, holder).
+		Updates(map[string]interface{}{"holder": "", "expires_at": gorm.Expr("NOW()")}).Error
+}
+
+// leaseSet hält die Sperren eines Laufs und verlängert sie, bis release aufgerufen wird.
+type leaseSet struct {
+	db     *gorm.DB
+	holder string
+	global bool
+	mu     sync.Mutex
+	held   map[string]bool
+	owned  []uint // Institutionen der Instanz im Modus split
+	lost   map[string][]context.CancelFunc
+	stop   chan struct{}
+}
+
+// acquireLeases holt im Modus single die Sperre für den ganzen Crawler,
+// im Modus split je Institution, die der Instanz gehört, eine Sperre.
+func acquireLeases(dbClient *gorm.DB, ucsSyncSetupMap map[uint]ucsSyncSetup) (*leaseSet, error) {
+	l := &leaseSet{
+		db:     dbClient,
+		holder: leaseHolder,
+		global: leaseMode() == leaseModeSingle,
+		held:   make(map[string]bool),
+		lost:   make(map[string][]context.CancelFunc),
+		stop:   make(chan struct{}),
+	}
+
+	var names []string
+	if l.global {
+		names = append(names, serviceName)
+	} else {
+		var institutionIDs []uint
+		for institutionID := range ucsSyncSetupMap {
+			institutionIDs = append(institutionIDs, institutionID)
+		}
+		owned, err := ownedInstitutions(dbClient, institutionIDs)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Instance", l.holder, "owns institutions", owned)
+		l.owned = owned
+		for _, institutionID := range owned {
+			names = append(names, institutionLeaseName(institutionID))
+		}
+	}
+	for _, name := range names {
+		ok, err := acquireLease(dbClient, name, l.holder)
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		if ok {
+			l.held[name] = true
+		}
+	}
+
+	go l.renew()
+	return l, nil
+}
+
+func (l *leaseSet) renew() {
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			for name := range l.held {
+				ok, err := acquireLease(l.db, name, l.holder)
+				if err != nil || !ok {
+					log.Println("Lost lease", name, err)
+					delete(l.held, name)
+					for _, cancel := range l.lost[name] {
+						cancel()
+					}
+					delete(l.lost, name)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// holds meldet, ob die Instanz die Institution noch bearbeiten darf.
+func (l *leaseSet) holds(institutionID uint) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held[l.name(institutionID)]
+}
+
+func (l *leaseSet) name(institutionID uint) string {
+	if l.global {
+		return serviceName
+	}
+	return institutionLeaseName(institutionID)
+}
+
+// context liefert einen Kontext für die Institution, der endet, sobald ihre Sperre verloren geht.
+func (l *leaseSet) context(ctx context.Context, institutionID uint) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if l == nil {
+		return ctx, cancel
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name := l.name(institutionID)
+	if !l.held[name] {
+		cancel()
+		return ctx, cancel
+	}
+	l.lost[name] = append(l.lost[name], cancel)
+	return ctx, cancel
+}
+
+func (l *leaseSet) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.held)
+}
+
+func (l *leaseSet) release() {
+	select {
+	case <-l.stop:
+		return
+	default:
+		close(l.stop)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name := range l.held {
+		err := releaseLease(l.db, name, l.holder)
+		if err != nil {
+			log.Println("Release lease", name, err)
+		}
+		delete(l.held, name)
+	}
+}
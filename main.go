@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,9 +16,13 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -180,23 +186,46 @@ func processQueue(queue *[]string) error {
 }
 
 // Für die Nebenläufigkeit
-var dataInProcess map[string]bool
+var dataInProcess = make(map[string]bool)
+var dataInProcessMu sync.Mutex
 
-func lockUser(personid string) {
+// lockUser sperrt eine Person für die Bearbeitung. Ist sie schon gesperrt, wird false geliefert.
+func lockUser(personid string) bool {
+	dataInProcessMu.Lock()
+	defer dataInProcessMu.Unlock()
+	if dataInProcess[personid] {
+		return false
+	}
 	dataInProcess[personid] = true
+	return true
 }
 
 func unlockUser(personid string) {
-	dataInProcess[personid] = false
+	dataInProcessMu.Lock()
+	defer dataInProcessMu.Unlock()
+	delete(dataInProcess, personid)
 }
 
 func isUserlocked(personid string) bool {
+	dataInProcessMu.Lock()
+	defer dataInProcessMu.Unlock()
 	return dataInProcess[personid]
 }
 
+func lockedUsers() []string {
+	dataInProcessMu.Lock()
+	defer dataInProcessMu.Unlock()
+	var personids []string
+	for personid := range dataInProcess {
+		personids = append(personids, personid)
+	}
+	return personids
+}
+
 type ucsSyncSetup struct {
 	UCSSetupAdminSpecification              bool
 	UCSSetupAdminLastNames                  []string
+	UCSSetupAdminRules                      []UcsAdminRule // mit den Nachnamen, wird nach loadSyncSetups nur gelesen
 	UCSSetupMakeTeacherFirstnameToOneLetter bool
 	UCSSetupMakeStudentFirstnameToOneLetter bool
 	UCSSetupMakeStudentFirstnameToOneName   bool
@@ -204,11 +233,18 @@ type ucsSyncSetup struct {
 	UCSSetupPeronFullFirstNames             []string
 	UCSSetupEmailNotToSync                  bool
 	UCSSetupSyncDisabled                    bool
-	itsl                                    *imses.Request
+	itsl                                    *itslClient
 	db                                      *gorm.DB
 	dbClient                                *gorm.DB
 	OUSelect                                bool     // Nur bestimmte OUs übertragen
 	Ous                                     []string // Alle OUS die übertragen werden müssen
+	RoleMapping                             roleMapping
+	GroupFilter                             groupFilter
+	CrawlerSetup                            UniventionCrawlerSetup
+	Hierarchy                               hierarchy
+	Groups                                  *groupCache
+	Store                                   *store
+	InstitutionID                           uint
 }
 
 var logCache []string
@@ -216,20 +252,84 @@ var lock sync.Mutex
 var loggingtime time.Time
 
 func main() {
-	loggingtime = time.Now()
+	allDatabases := openDatabases()
+
+	// SIGINT und SIGTERM beenden die laufenden Personen als "interrupted, retry".
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "runs":
+			err = runsCommand(allDatabases, os.Args[2:])
+		case "daemon":
+			err = daemonCommand(ctx, allDatabases, os.Args[2:])
+		case "audit":
+			err = auditCommand(allDatabases, os.Args[2:])
+		case "retention":
+			err = retentionCommand(allDatabases, os.Args[2:])
+		case "brake":
+			err = brakeCommand(allDatabases, os.Args[2:])
+		case "approvals":
+			err = approvalsCommand(allDatabases, os.Args[2:])
+		case "reconcile":
+			err = reconcileCommand(ctx, allDatabases, os.Args[2:])
+		case "groups":
+			err = groupsCommand(ctx, allDatabases, os.Args[2:])
+		case "rollover":
+			err = rolloverCommand(ctx, allDatabases, os.Args[2:])
+		default:
+			err = errors.New("unknown command " + os.Args[1])
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
-	sendLog("Start UCS Person Crawler")
+	crawl(ctx, allDatabases)
+	pushMetrics()
+}
+
+// daemonCommand läuft dauerhaft und stellt /metrics und die Admin-API bereit: ucs_crawler daemon [-listen :9102] [-interval 10m]
+func daemonCommand(ctx context.Context, allDatabases map[string]*gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := flags.String("listen", ":9102", "address of the HTTP endpoint")
+	interval := flags.Duration("interval", 10*time.Minute, "pause between two runs")
+	flags.Parse(args)
+
+	// Der Daemon lädt die Einstellungen vor jedem Lauf und bei Anfragen an die Admin-API, die Tabellen werden vorher einmal angelegt.
+	err := migrateDatabases(allDatabases)
+	if err != nil {
+		return err
+	}
 
-	// Einrichten für die Nebenläufigkeit
-	dataInProcess = make(map[string]bool)
+	mux := http.NewServeMux()
+	serveMetrics(mux)
+	serveAdminAPI(ctx, mux, allDatabases)
+	go func() {
+		log.Println(http.ListenAndServe(*listen, mux))
+	}()
 
-	// Datenbank einrichten
+	for {
+		crawl(ctx, allDatabases)
+		select {
+		case <-ctx.Done():
+			log.Println("Daemon stopped:", ctx.Err())
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// openDatabases öffnet alle Datenbanken aus der databaseconfig.json. Schlüssel ist NameOrCID.
+func openDatabases() map[string]*gorm.DB {
 	var databaseConfig []itswizard_basic.DatabaseConfig
 	b, _ := awsBrooker.DownloadFileFromBucket("brooker", "admin/databaseconfig.json")
 	err := json.Unmarshal(b, &databaseConfig)
 	if err != nil {
 		panic("Error by reading database file " + err.Error())
-		return
 	}
 	allDatabases := make(map[string]*gorm.DB)
 	for i := 0; i < len(databaseConfig); i++ {
@@ -239,30 +339,135 @@ func main() {
 		}
 		allDatabases[databaseConfig[i].NameOrCID] = database
 	}
+	return allDatabases
+}
 
-	var ucsSyncSetupMap map[uint]ucsSyncSetup
+func crawl(ctx context.Context, allDatabases map[string]*gorm.DB) {
+	loggingtime = time.Now()
+	runStart := time.Now()
+
+	sendLog("Start UCS Person Crawler")
+
+	if !currentStatus.start("crawl", 0) {
+		sendLog("A run is already in progress")
+		return
+	}
+	var runErr error
+	defer func() {
+		currentStatus.finish(runErr)
+	}()
+
+	err := migrateOnce(allDatabases["Client"], migrateClientDatabase)
+	if err != nil {
+		sendLog("Error while migrating client database: " + err.Error() + "Stop programm")
+		log.Println(err)
+		runErr = err
+		return
+	}
 
 	log.Println("Writing in Database that the service is running")
-	var runningService RunningService
-	err = allDatabases["Client"].Where("service_name = ?", "UCSPersonCrawler").Find(&runningService).Error
+	if currentHeartbeat == nil {
+		currentHeartbeat, err = startHeartbeat(allDatabases["Client"])
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = currentHeartbeat.runStarted()
 	if err != nil {
 		panic(err)
+	}
+	defer func() {
+		currentHeartbeat.runFinished(runErr)
+	}()
+
+	ucsSyncSetupMap, err := loadSyncSetups(allDatabases)
+	if err != nil {
+		runErr = err
 		return
 	}
-	runningService.LastRun = time.Now().String()
-	err = allDatabases["Client"].Save(&runningService).Error
+
+	leases, err := acquireLeases(allDatabases["Client"], ucsSyncSetupMap)
 	if err != nil {
-		panic(err)
+		runErr = err
+		sendLog("Error while acquiring lease: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return
+	}
+	defer leases.release()
+	if !leases.global {
+		currentHeartbeat.setInstitutions(leases.owned)
+	}
+	if leases.count() == 0 {
+		sendLog("Another instance is running, nothing to do for " + instanceID())
 		return
 	}
 
+	// Schreibvorgänge, die im letzten Lauf nicht gespeichert werden konnten, nachholen
+	err = journal.replay(allDatabases)
+	if err != nil {
+		sendLog("Error while replaying journal: " + err.Error())
+		log.Println(err)
+	}
+
+	//Start sync to itslearning
+	for institutionID, setup := range ucsSyncSetupMap {
+		if !leases.holds(institutionID) {
+			continue
+		}
+		if setup.CrawlerSetup.PrefillGroupCache {
+			prefillGroupCache(ctx, setup)
+		}
+	}
+	run := newRunReport(runStart)
+	runScheduler(withRunReport(ctx, run), ucsSyncSetupMap, runStart, leases)
+
+	// Vollständiger Abgleich, die gefundenen Abweichungen werden im nächsten Lauf behoben
+	for institutionID, setup := range ucsSyncSetupMap {
+		if ctx.Err() != nil || !leases.holds(institutionID) || !setup.Store.healthy() || !reconcileDue(setup) {
+			continue
+		}
+		reconcileCtx, cancel := leases.context(ctx, institutionID)
+		_, err = reconcileInstitution(withRunID(reconcileCtx, run.id()), setup, false)
+		cancel()
+		if err != nil {
+			sendLog("Error while reconciling institution " + strconv.Itoa(int(institutionID)) + ": " + err.Error())
+			log.Println(err)
+		}
+	}
+
+	// Nicht mehr genutzte Gruppen archivieren oder löschen
+	for institutionID, setup := range ucsSyncSetupMap {
+		if ctx.Err() != nil || !leases.holds(institutionID) || !setup.Store.healthy() || setup.CrawlerSetup.GroupCleanupDays <= 0 {
+			continue
+		}
+		cleanupCtx, cancel := leases.context(ctx, institutionID)
+		runGroupCleanup(cleanupCtx, setup)
+		cancel()
+	}
+	finished := time.Now()
+	if ctx.Err() != nil {
+		runErr = ctx.Err()
+		sendLog("Run interrupted: " + ctx.Err().Error())
+	} else {
+		markRunSuccessful(finished)
+	}
+	err = run.save(allDatabases["Client"], finished)
+	if err != nil {
+		runErr = err
+		sendLog("Error while saving run report: " + err.Error())
+		log.Println(err)
+	}
+}
+
+// loadSyncSetups liest für jede Institution mit run_person_crawler die Einstellungen des Laufs.
+func loadSyncSetups(allDatabases map[string]*gorm.DB) (map[uint]ucsSyncSetup, error) {
 	log.Println("Check if new Clients are need to add to the loop")
 
-	ucsSyncSetupMap = make(map[uint]ucsSyncSetup)
+	ucsSyncSetupMap := make(map[uint]ucsSyncSetup)
 
 	fmt.Println("Get all Univention Services from Database")
 	var univentionServices []itswizard_basic.UniventionService
-	err = allDatabases["Client"].Where("run_person_crawler = ?", true).Find(&univentionServices).Error
+	err := allDatabases["Client"].Where("run_person_crawler = ?", true).Find(&univentionServices).Error
 	if err != nil {
 		sendLog(err.Error() + "while reading run_with_update = true")
 		log.Println(err)
@@ -270,206 +475,224 @@ func main() {
 			InstitutionID: 0,
 			Error:         err.Error(),
 		})
-		return
+		return nil, err
 	}
 
 	fmt.Println("Create UCS Setup to range throw it")
 
 	for _, univentionSerice := range univentionServices {
-
-		log.Println(univentionSerice.InsitutionID)
-		db := allDatabases[strconv.Itoa(int(univentionSerice.InsitutionID))]
-		//Get All IMSES DAta
-		var imsesSetup itswizard_basic.ImsesSetup
-		err = db.Last(&imsesSetup).Error
+		syncSetup, err := loadSyncSetupFor(allDatabases, univentionSerice)
 		if err != nil {
-			sendLog("Error while getting imses setup: " + err.Error() + "Stop programm")
-			log.Println(err)
-			return
+			return nil, err
 		}
-		itsl := imses.NewImsesService(imses.NewImsesServiceInput{
-			Username: imsesSetup.Username,
-			Password: imsesSetup.Password,
-			Url:      imsesSetup.Endpoint,
-		})
+		ucsSyncSetupMap[univentionSerice.InsitutionID] = syncSetup
+	}
+	return ucsSyncSetupMap, nil
+}
 
-		//Get UCSSetup
-		var ucssetup itswizard_basic.UniventionSetup
-		err = db.Last(&ucssetup).Error
-		if err != nil {
-			sendLog("Error while getting univention setup: " + err.Error() + "Stop programm")
-			log.Println(err)
-			return
-		}
+// loadSyncSetupFor liest die Einstellungen des Laufs für eine Institution.
+func loadSyncSetupFor(allDatabases map[string]*gorm.DB, univentionSerice itswizard_basic.UniventionService) (ucsSyncSetup, error) {
+	log.Println(univentionSerice.InsitutionID)
+	db := allDatabases[strconv.Itoa(int(univentionSerice.InsitutionID))]
+	err := migrateOnce(db, migrateInstitutionDatabase)
+	if err != nil {
+		sendLog("Error while migrating institution database: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+	//Get All IMSES DAta
+	var imsesSetup itswizard_basic.ImsesSetup
+	err = db.Last(&imsesSetup).Error
+	if err != nil {
+		sendLog("Error while getting imses setup: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+	itsl := &itslClient{Request: imses.NewImsesService(imses.NewImsesServiceInput{
+		Username: imsesSetup.Username,
+		Password: imsesSetup.Password,
+		Url:      imsesSetup.Endpoint,
+	})}
 
-		var adminLastnames []string
-		if ucssetup.AdminSpecification {
-			var adminspec []itswizard_basic.UniventionAdminSpecifiaction
-			err = db.Find(&adminspec).Error
-			if err != nil {
-				sendLog("Error while getting UniventionAdminSpecifiaction: " + err.Error() + "Stop programm")
-				log.Println(err)
-				return
-			}
-			for _, data := range adminspec {
-				adminLastnames = append(adminLastnames, data.AdminLastName)
-			}
+	//Get UCSSetup
+	var ucssetup itswizard_basic.UniventionSetup
+	err = db.Last(&ucssetup).Error
+	if err != nil {
+		sendLog("Error while getting univention setup: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+
+	var crawlerSetup UniventionCrawlerSetup
+	err = db.Last(&crawlerSetup).Error
+	if err != nil {
+		log.Println(err)
+		if err.Error() != "record not found" {
+			sendLog("Error while getting UniventionCrawlerSetup: " + err.Error() + "Stop programm")
+			return ucsSyncSetup{}, err
 		}
+	}
+	itsl.timeout = crawlerSetup.callTimeout()
 
-		var fullFirstNames []itswizard_basic.UniventionPersonFullFirstName
-		err = db.Find(&fullFirstNames).Error
+	var hierarchyNodes []UcsHierarchyNode
+	err = db.Find(&hierarchyNodes).Error
+	if err != nil {
+		sendLog("Error while getting UcsHierarchyNode: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+
+	var adminLastnames []string
+	var adminRules []UcsAdminRule
+	if ucssetup.AdminSpecification {
+		var adminspec []itswizard_basic.UniventionAdminSpecifiaction
+		err = db.Find(&adminspec).Error
 		if err != nil {
-			fmt.Println("There is no UniventionPersonFullFirstname: " + err.Error())
+			sendLog("Error while getting UniventionAdminSpecifiaction: " + err.Error() + "Stop programm")
 			log.Println(err)
-			if err.Error() != "record not found" {
-				sendLog("Error while getting UniventionPersonFullFirstName: " + err.Error() + "Stop programm")
-				log.Println(err)
-				return
-			}
+			return ucsSyncSetup{}, err
 		}
-
-		var firstnames []string
-		for _, name := range fullFirstNames {
-			firstnames = append(firstnames, name.PersonSyncKey)
+		for _, data := range adminspec {
+			adminLastnames = append(adminLastnames, data.AdminLastName)
 		}
-
-		var ous []string
-		if univentionSerice.SelectOrganisations {
-			var organisationSelects []itswizard_basic.UniventionOrganisationSelect
-			err = allDatabases["Client"].Where("institution_id = ? and active = ?", univentionSerice.InsitutionID, true).Find(&organisationSelects).Error
-			if err != nil {
-				fmt.Println("There is no UniventionOrganisationSelect: " + err.Error())
-				log.Println(err)
-				if err.Error() != "record not found" {
-					sendLog("Error while getting UniventionPersonFullFirstName: " + err.Error() + "Stop programm")
-					log.Println(err)
-					return
-				}
-			}
-			for _, selectOrganisation := range organisationSelects {
-				ous = append(ous, selectOrganisation.OUName)
-			}
+		err = db.Find(&adminRules).Error
+		if err != nil {
+			sendLog("Error while getting UcsAdminRule: " + err.Error() + "Stop programm")
+			log.Println(err)
+			return ucsSyncSetup{}, err
 		}
+		for _, lastname := range adminLastnames {
+			adminRules = append(adminRules, UcsAdminRule{RuleType: adminRuleLastName, Value: lastname})
+		}
+	}
 
-		ucsSyncSetupMap[univentionSerice.InsitutionID] = ucsSyncSetup{
-			UCSSetupAdminSpecification:              ucssetup.AdminSpecification,
-			UCSSetupAdminLastNames:                  adminLastnames,
-			UCSSetupPeronFullFirstNames:             firstnames,
-			UCSSetupMakeTeacherFirstnameToOneLetter: ucssetup.MakeTeacherFirstnameToOneLetter,
-			UCSSetupMakeStudentFirstnameToOneLetter: ucssetup.MakeStudentFirstnameToOneLetter,
-			UCSSetupMakeStudentFirstnameToOneName:   ucssetup.MakeStudentFirstnameToOneName,
-			UCSSetupMakeTeacherFirstnameToOneName:   ucssetup.MakeTeacherFirstnameToOneName,
-			UCSSetupEmailNotToSync:                  ucssetup.EmailNotToSync,
-			UCSSetupSyncDisabled:                    ucssetup.SyncDisable,
-			itsl:                                    itsl,
-			db:                                      db,
-			dbClient:                                allDatabases["Client"],
-			OUSelect:                                univentionSerice.SelectOrganisations,
-			Ous:                                     ous,
+	var fullFirstNames []itswizard_basic.UniventionPersonFullFirstName
+	err = db.Find(&fullFirstNames).Error
+	if err != nil {
+		fmt.Println("There is no UniventionPersonFullFirstname: " + err.Error())
+		log.Println(err)
+		if err.Error() != "record not found" {
+			sendLog("Error while getting UniventionPersonFullFirstName: " + err.Error() + "Stop programm")
+			log.Println(err)
+			return ucsSyncSetup{}, err
 		}
 	}
 
-	//Start sync to itslearning
-	for institutionID, setup := range ucsSyncSetupMap {
+	var firstnames []string
+	for _, name := range fullFirstNames {
+		firstnames = append(firstnames, name.PersonSyncKey)
+	}
 
-		// Import
-		var importDatas []itswizard_basic.UniventionPerson
-		err = setup.db.Where("to_import = 1 and error = 0").Order("updated_at").Find(&importDatas).Error
-		if err != nil {
-			if err.Error() != "record not found" {
-				sendLog("Error while getting UniventionPerson to import: " + err.Error() + "Stop programm")
-				log.Println(err)
-				return
-			}
-		}
-		for _, importdatao := range importDatas {
-			if importdatao.Data != "" {
-				sendLog(ucsImportUser(setup, importdatao, institutionID))
-			}
-		}
+	var roleMappings []UcsRoleMapping
+	err = db.Find(&roleMappings).Error
+	if err != nil {
+		sendLog("Error while getting UcsRoleMapping: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
 
-		// Delete
-		var deleteData []itswizard_basic.UniventionPerson
-		err = setup.db.Where("to_delete = 1 and success = 0 and error = 0").Limit(500).Find(&deleteData).Error
-		if err != nil {
-			if err.Error() != "record not found" {
-				sendLog("Error while getting UniventionPerson to delete: " + err.Error() + "Stop programm")
-				log.Println(err)
-				return
-			}
-		}
-		for _, v := range deleteData {
-			if v.Data != "" {
-				sendLog(ucsDeleteUser(setup, v, institutionID))
-			}
+	var teacherGroupNames []itswizard_basic.UcsTeacherGroupName
+	err = db.Find(&teacherGroupNames).Error
+	if err != nil {
+		log.Println(err)
+		if err.Error() != "record not found" {
+			sendLog("Error while getting UcsTeacherGroupName: " + err.Error() + "Stop programm")
+			return ucsSyncSetup{}, err
 		}
+	}
+	var groupFilterRules []UcsGroupFilterRule
+	err = db.Find(&groupFilterRules).Error
+	if err != nil {
+		sendLog("Error while getting UcsGroupFilterRule: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+	var groupTypePatterns []UcsGroupTypePattern
+	err = db.Find(&groupTypePatterns).Error
+	if err != nil {
+		sendLog("Error while getting UcsGroupTypePattern: " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
+	filter, err := newGroupFilter(groupFilterRules, groupTypePatterns, teacherGroupNames)
+	if err != nil {
+		sendLog("Error in group filter of institution " + strconv.Itoa(int(univentionSerice.InsitutionID)) + ": " + err.Error() + "Stop programm")
+		log.Println(err)
+		return ucsSyncSetup{}, err
+	}
 
-		// Update
-		var updateDatas []itswizard_basic.UniventionPerson
-		err = setup.db.Where("to_update = 1 and error = 0 ").Limit(200).Find(&updateDatas).Error
+	var ous []string
+	if univentionSerice.SelectOrganisations {
+		var organisationSelects []itswizard_basic.UniventionOrganisationSelect
+		err = allDatabases["Client"].Where("institution_id = ? and active = ?", univentionSerice.InsitutionID, true).Find(&organisationSelects).Error
 		if err != nil {
+			fmt.Println("There is no UniventionOrganisationSelect: " + err.Error())
+			log.Println(err)
 			if err.Error() != "record not found" {
-				sendLog("Error while getting UniventionPerson to updste: " + err.Error() + "Stop programm")
+				sendLog("Error while getting UniventionPersonFullFirstName: " + err.Error() + "Stop programm")
 				log.Println(err)
-				return
+				return ucsSyncSetup{}, err
 			}
 		}
-		var ch = make(chan string, len(updateDatas))
-		for _, updateData := range updateDatas {
-			log.Println("Update")
-			go ucsUpdateUser(setup, updateData, institutionID, ch)
-		}
-
-		for i := 0; i < len(updateDatas); i++ {
-			log.Println("Log Prozess!")
-			//		log.Println(<-ch)
-			sendLog(<-ch)
+		for _, selectOrganisation := range organisationSelects {
+			ous = append(ous, selectOrganisation.OUName)
 		}
 	}
+
+	return ucsSyncSetup{
+		UCSSetupAdminSpecification:              ucssetup.AdminSpecification,
+		UCSSetupAdminLastNames:                  adminLastnames,
+		UCSSetupAdminRules:                      adminRules,
+		UCSSetupPeronFullFirstNames:             firstnames,
+		UCSSetupMakeTeacherFirstnameToOneLetter: ucssetup.MakeTeacherFirstnameToOneLetter,
+		UCSSetupMakeStudentFirstnameToOneLetter: ucssetup.MakeStudentFirstnameToOneLetter,
+		UCSSetupMakeStudentFirstnameToOneName:   ucssetup.MakeStudentFirstnameToOneName,
+		UCSSetupMakeTeacherFirstnameToOneName:   ucssetup.MakeTeacherFirstnameToOneName,
+		UCSSetupEmailNotToSync:                  ucssetup.EmailNotToSync,
+		UCSSetupSyncDisabled:                    ucssetup.SyncDisable,
+		itsl:                                    itsl,
+		db:                                      db,
+		dbClient:                                allDatabases["Client"],
+		OUSelect:                                univentionSerice.SelectOrganisations,
+		Ous:                                     ous,
+		RoleMapping:                             newRoleMapping(roleMappings),
+		GroupFilter:                             filter,
+		CrawlerSetup:                            crawlerSetup,
+		Hierarchy:                               newHierarchy(hierarchyNodes, crawlerSetup.SchoolParentSyncID),
+		Groups:                                  newGroupCache(),
+		Store:                                   newStore(db, univentionSerice.InsitutionID),
+		InstitutionID:                           univentionSerice.InsitutionID,
+	}, nil
 }
 
-func ucsImportUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, institutionID uint) (out string) {
+func ucsImportUser(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, institutionID uint) (out string) {
+	ctx, trail := startAudit(ctx)
 
 	log.Println("Checke ob Person nciht gelöscht werden sollte statt import")
 	if strings.Contains(person.Data, `object": null,`) {
 		out = out + "Person is to delete"
 		log.Println(out)
-		person.ToUpdate = false
-		person.ToDelete = true
-		person.Success = false
-		person.Errorstring = ""
-		person.Error = false
-		person.ToImport = false
-		person.UpdateStammschule = false
-		person.UdpateFirstName = false
-		person.UdpateUsername = false
-		person.UdpateProfile = false
-		person.UdpateProfile = false
-		person.UpdateGruppenMitgliedschaften = false
-		person.UpdateSchulmitgliedschaften = false
-		person.UpdateEmail = false
-		person.UpdateDisable = false
-
-		syncSetup.db.Save(&person)
+		transitionPerson(ctx, syncSetup, person, eventRemoved, nil)
 		return
 	}
 
 	log.Println("importiere Person", person.Username)
 
-	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person)
+	toAdmin := makeToAdmin(syncSetup, person)
+	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person, toAdmin)
 	if err != nil {
 		out = out + "getSchulmitgliedschaften " + err.Error()
 		log.Println(err)
-		saveImportedPersonWithError(syncSetup, person, err)
+		transitionPerson(ctx, syncSetup, person, eventFailed, err)
 		return
 	}
 
-	gruppenmitgliedschaften, err := getGruppenmitgliedschaftenWolfsburg(person, syncSetup.db)
-	//	gruppenmitgliedschaften, err := getGruppenmitgliedschaften(person)
+	roles := readSchoolRoles(syncSetup, person)
+	gruppenmitgliedschaften, err := getGruppenmitgliedschaften(syncSetup, person, roles)
 	if err != nil {
 		out = out + "getGruppenmitgliedschaften " + err.Error()
 		log.Println(err)
-		saveImportedPersonWithError(syncSetup, person, err)
+		transitionPerson(ctx, syncSetup, person, eventFailed, err)
 		return
 	}
 
@@ -477,78 +700,102 @@ func ucsImportUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 	if !isPersonToImport {
 		out = "PERSON IS NOT TO IMPORT"
 		log.Println("PERSON IS NOT TO IMPORT")
-		saveImportedPersonWithSuccess(syncSetup, person)
+		transitionPerson(ctx, syncSetup, person, eventSkipped, nil)
 		return
 	}
 	out = out + "Person " + person.Username + " wird importiert von id" + strconv.Itoa(int(institutionID))
 	log.Println("Person "+person.Username+" wird importiert von id", institutionID)
+	if isAdmin, reason := adminDesignation(syncSetup, person); isAdmin {
+		out = out + " wird Administrator: " + reason
+		log.Println("Person", person.Username, "wird Administrator:", reason)
+		if syncSetup.CrawlerSetup.ApproveAdmins {
+			requestAdminApproval(ctx, syncSetup, person, reason)
+		}
+	}
 	// Person importieren
-	resp, err := syncSetup.itsl.CreatePerson(itswizard_basic.DbPerson15{
-		SyncPersonKey: person.PersonSyncKey,
-		FirstName:     prepareFirstname(syncSetup, person),
-		LastName:      prepareLastname(person),
-		Username:      person.Username,
-		Profile:       prepareProfil(person, makeToAdmin(syncSetup, person)),
-		Email:         prepareEmail(syncSetup, person),
-	})
+	prepared := preparePerson(syncSetup, person, roles, toAdmin)
+	resp, err := syncSetup.itsl.CreatePerson(ctx, prepared)
 
 	if err != nil {
 		out = out + "Create Person with error" + person.Username + err.Error()
 		log.Println(err)
-		saveImportedPersonWithError(syncSetup, person, errors.New(resp))
+		transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
+		return
+	}
+	trail.sent = auditValuesOf(prepared)
+
+	// Wieder in UCS angelegt: die Quarantänegruppe wird durch die Mitgliedschaften aus UCS ersetzt
+	softDelete, err := activeSoftDelete(syncSetup.db, person.PersonSyncKey)
+	if err != nil {
+		transitionPerson(ctx, syncSetup, person, eventFailed, err)
 		return
 	}
+	if softDelete != nil {
+		log.Println("Person", person.Username, "ist zurück aus der Quarantäne")
+		resp, err = removeMemberships(ctx, syncSetup, trail, person.PersonSyncKey)
+		if err != nil {
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
+			return
+		}
+	}
 
 	for school, profil := range schulmitgliedschaften {
 		if !IsSchoolToImportOuSelect(syncSetup, school, institutionID) {
-			break
+			continue
 		}
 
-		err = checkIfSchoolExist(syncSetup, school)
+		err = checkIfSchoolExist(ctx, syncSetup, school)
 		if err != nil {
-			saveImportedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			return
 		}
 		out = out + " importiere Schulmitgliedschaft " + person.Username + " " + school
 		log.Println("importiere Schulmitgliedschaft", person.Username, school)
-		resp, err := syncSetup.itsl.CreateMembership(school, person.PersonSyncKey, profil)
+		resp, err := syncSetup.itsl.CreateMembership(ctx, school, person.PersonSyncKey, profil)
 		if err != nil {
 			log.Println(err)
 			out = out + "Problem by creating Membership " + school + person.PersonSyncKey + profil
-			saveImportedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			return
 		}
+		trail.addMembership(school, profil)
 	}
 
 	// 3. Gruppenmitgliedschaften erstellen
 	for group, school := range gruppenmitgliedschaften {
 		if !IsSchoolToImportOuSelect(syncSetup, school, institutionID) {
-			break
+			continue
 		}
-		if makeToAdmin(syncSetup, person) {
+		if toAdmin {
 			break
 		}
-		err = checkIfGroupExist(syncSetup, group, school)
+		err = checkIfGroupExist(ctx, syncSetup, group, school)
 		if err != nil {
-			saveImportedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			return
 		}
 
 		log.Println("importiere Gruppenmitgliedschaft", person.Username, group, "von id", institutionID)
 		out = out + "importiere Gruppenmitgliedschaft " + person.Username + " " + group + " von id " + strconv.Itoa(int(institutionID))
 
-		resp, err := syncSetup.itsl.CreateMembership(group, person.PersonSyncKey, schulmitgliedschaften[school])
+		role := groupRole(syncSetup, person, schulmitgliedschaften, school)
+		resp, err := syncSetup.itsl.CreateMembership(ctx, group, person.PersonSyncKey, role)
 		if err != nil {
-			saveImportedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			return
 		}
+		trail.addMembership(group, role)
 	}
 
-	saveImportedPersonWithSuccess(syncSetup, person)
+	if softDelete != nil {
+		restoreSoftDelete(syncSetup, softDelete)
+	}
+	transitionPerson(ctx, syncSetup, person, eventSucceeded, nil)
 	return
 }
 
-func ucsDeleteUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, insstitutionid uint) (out string) {
+func ucsDeleteUser(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, insstitutionid uint) (out string) {
+	ctx, trail := startAudit(ctx)
 	out = out + "Lösche Person " + person.Username + " institutionid " + strconv.Itoa(int(insstitutionid))
 	log.Println("Lösche Person", person.Username, "institutionid", insstitutionid)
 	out = out + "Checke ob Person wirklich gelöscht werden sollte"
@@ -556,41 +803,93 @@ func ucsDeleteUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 	if !strings.Contains(person.Data, `object": null,`) {
 		log.Println("Person ist nicht zu löschen, versuche ein update")
 		out = out + "Person ist nicht zu löschen, versuche ein update"
-		person.ToUpdate = true
-		person.ToDelete = false
-		person.Success = false
-		person.Errorstring = ""
-		person.Error = false
-		person.ToImport = false
-		person.UpdateStammschule = false
-		person.UdpateFirstName = true
-		person.UdpateUsername = true
-		person.UdpateProfile = true
-		person.UpdateGruppenMitgliedschaften = true
-		person.UpdateSchulmitgliedschaften = true
-		person.UpdateEmail = true
-
-		syncSetup.db.Save(&person)
+		if syncSetup.CrawlerSetup.ApproveDeletes {
+			withdrawApproval(syncSetup, person)
+		}
+		transitionPerson(ctx, syncSetup, person, eventPresent, nil)
 		return
 	}
+	// Schonfrist: erst in die Quarantänegruppe, gelöscht wird nach Ablauf
+	var softDelete *UcsSoftDelete
+	if syncSetup.CrawlerSetup.deleteGrace() > 0 {
+		var err error
+		softDelete, err = activeSoftDelete(syncSetup.db, person.PersonSyncKey)
+		if err != nil {
+			transitionPerson(ctx, syncSetup, person, eventFailed, err)
+			return
+		}
+	}
+
+	// Freigabe: einmal vor der Quarantäne oder der Löschung
+	var approval *UcsApproval
+	if syncSetup.CrawlerSetup.ApproveDeletes && softDelete == nil {
+		var err error
+		approval, err = requestApproval(ctx, syncSetup, person, approvalDelete, "removed in UCS")
+		if err != nil {
+			transitionPerson(ctx, syncSetup, person, eventFailed, err)
+			return
+		}
+		switch approval.Status {
+		case approvalPending:
+			log.Println("Löschung von", person.Username, "wartet auf Freigabe")
+			out = out + "Löschung wartet auf Freigabe"
+			return
+		case approvalRejected:
+			log.Println("Löschung von", person.Username, "abgelehnt durch", approval.DecidedBy)
+			out = out + "Löschung abgelehnt durch " + approval.DecidedBy
+			finishApproval(syncSetup, approval)
+			transitionPerson(ctx, syncSetup, person, eventRejected, nil)
+			return
+		}
+	}
+
+	if syncSetup.CrawlerSetup.deleteGrace() > 0 {
+		if softDelete == nil {
+			log.Println("Verschiebe Person", person.Username, "in die Quarantäne")
+			out = out + "Verschiebe Nutzer " + person.Username + " in die Quarantäne"
+			resp, err := quarantinePerson(ctx, syncSetup, trail, person)
+			if err != nil {
+				transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
+				return
+			}
+			if approval != nil {
+				finishApproval(syncSetup, approval)
+			}
+			transitionPerson(ctx, syncSetup, person, eventQuarantined, nil)
+			return
+		}
+		if err := checkGracePeriod(syncSetup, softDelete); err != nil {
+			log.Println("Person", person.Username, err)
+			out = out + err.Error()
+			return
+		}
+	}
 	log.Println("Lösche")
 	out = out + "Lösche Nutzer " + person.Username
-	resp, err := syncSetup.itsl.DeletePerson(person.PersonSyncKey)
+	resp, err := syncSetup.itsl.DeletePerson(ctx, person.PersonSyncKey)
 	if err != nil {
-		saveDeletedPersonWithError(syncSetup, person, errors.New(resp))
+		transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 		return
 	}
-	saveDeletedPersonWithSuccess(syncSetup, person)
+	if approval != nil {
+		finishApproval(syncSetup, approval)
+	}
+	if softDelete != nil {
+		finishSoftDelete(syncSetup, softDelete)
+	}
+	transitionPerson(ctx, syncSetup, person, eventSucceeded, nil)
 	out = out + "fertig gelöscht " + person.Username
 	log.Println("fertig gelöscht")
 	return
 }
 
-func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, insstitutionid uint, ch chan string) {
-	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person)
+func ucsUpdateUser(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, insstitutionid uint, ch chan string) {
+	ctx, trail := startAudit(ctx)
+	toAdmin := makeToAdmin(syncSetup, person)
+	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person, toAdmin)
 	if err != nil {
 		log.Println(err)
-		saveImportedPersonWithError(syncSetup, person, err)
+		transitionPerson(ctx, syncSetup, person, eventFailed, err)
 		ch <- fmt.Sprint(insstitutionid, person.Username, "Fehler bei der Schulmitgliedschaften")
 		return
 	}
@@ -598,29 +897,13 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 	isPersonToImport := isPersonToImport(syncSetup, person, insstitutionid, schulmitgliedschaften)
 	if !isPersonToImport {
 		log.Println("PERSON IS NOT TO IMPORT")
-		saveImportedPersonWithSuccess(syncSetup, person)
+		transitionPerson(ctx, syncSetup, person, eventSkipped, nil)
 		ch <- fmt.Sprint("PERSON IS NOT TO IMPORT", person.Username, insstitutionid)
 		return
 	}
 	log.Println("Checke ob Person nciht gelöscht werden sollte statt import")
 	if strings.Contains(person.Data, `object": null,`) {
-		person.ToUpdate = false
-		person.ToDelete = true
-		person.Success = false
-		person.Errorstring = ""
-		person.Error = false
-		person.ToImport = false
-		person.UpdateStammschule = false
-		person.UdpateFirstName = false
-		person.UdpateUsername = false
-		person.UdpateProfile = false
-		person.UdpateProfile = false
-		person.UpdateGruppenMitgliedschaften = false
-		person.UpdateSchulmitgliedschaften = false
-		person.UpdateEmail = false
-		person.UpdateDisable = false
-
-		syncSetup.db.Save(&person)
+		transitionPerson(ctx, syncSetup, person, eventRemoved, nil)
 		ch <- fmt.Sprint("Person is to delete", person.Username, insstitutionid)
 		return
 	}
@@ -632,54 +915,75 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 
 	//Checken ob nur Update ist:
 	person.UdpateFirstName = true
+	roles := readSchoolRoles(syncSetup, person)
+
+	// Wieder in UCS vorhanden: die Mitgliedschaften aus UCS ersetzen die Quarantänegruppe
+	softDelete, err := activeSoftDelete(syncSetup.db, person.PersonSyncKey)
+	if err != nil {
+		transitionPerson(ctx, syncSetup, person, eventFailed, err)
+		ch <- fmt.Sprint(person.Username, insstitutionid, "Read UcsSoftDelete", err)
+		return
+	}
+	if softDelete != nil {
+		log.Println("Person", person.Username, "ist zurück aus der Quarantäne")
+		person.UpdateSchulmitgliedschaften = true
+		person.UpdateGruppenMitgliedschaften = true
+	}
 
 	//1. Upoate FirstName
 	if person.UdpateFirstName {
-		resp, err := syncSetup.itsl.UpdateFirstName(person.PersonSyncKey, prepareFirstname(syncSetup, person))
+		firstName := prepareFirstname(syncSetup, person, roles)
+		resp, err := syncSetup.itsl.UpdateFirstName(ctx, person.PersonSyncKey, firstName)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Update Firstname", resp)
 			return
 		}
+		trail.sent.FirstName = firstName
 	}
 
 	//2. Upoate LastName
 	if person.UdpateLastName {
-		resp, err := syncSetup.itsl.UpdateLastName(person.PersonSyncKey, prepareLastname(person))
+		lastName := prepareLastname(person)
+		resp, err := syncSetup.itsl.UpdateLastName(ctx, person.PersonSyncKey, lastName)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Update Lastname", resp)
 			return
 		}
+		trail.sent.LastName = lastName
 	}
 
 	//3. Upoate UserName
 	if person.UdpateUsername {
-		resp, err := syncSetup.itsl.UpdateUsername(person.PersonSyncKey, person.Username)
+		username := person.Username
+		resp, err := syncSetup.itsl.UpdateUsername(ctx, person.PersonSyncKey, username)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Update Username", resp)
 			return
 		}
+		trail.sent.Username = username
 	}
 
 	//4. Update Profile
 	if person.UdpateProfile {
+		if isAdmin, reason := adminDesignation(syncSetup, person); isAdmin {
+			log.Println("Person", person.Username, "wird Administrator:", reason)
+			if syncSetup.CrawlerSetup.ApproveAdmins {
+				requestAdminApproval(ctx, syncSetup, person, reason)
+			}
+		}
 		// Person importieren
-		resp, err := syncSetup.itsl.CreatePerson(itswizard_basic.DbPerson15{
-			SyncPersonKey: person.PersonSyncKey,
-			FirstName:     prepareFirstname(syncSetup, person),
-			LastName:      prepareLastname(person),
-			Username:      person.Username,
-			Profile:       prepareProfil(person, makeToAdmin(syncSetup, person)),
-			Email:         prepareEmail(syncSetup, person),
-		})
+		prepared := preparePerson(syncSetup, person, roles, toAdmin)
+		resp, err := syncSetup.itsl.CreatePerson(ctx, prepared)
 
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Create Person", resp)
 			return
 		}
+		trail.sent = auditValuesOf(prepared)
 	}
 
 	//5. Update Stammschule
@@ -687,43 +991,37 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 
 	//6. Update Email
 	if person.UpdateEmail {
-		resp, err := syncSetup.itsl.UpdateEmail(person.PersonSyncKey, prepareEmail(syncSetup, person))
+		email := prepareEmail(syncSetup, person)
+		resp, err := syncSetup.itsl.UpdateEmail(ctx, person.PersonSyncKey, email)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Udpate Email", resp)
 			return
 		}
+		trail.sent.Email = email
 	}
 
 	//7. Update Schulmitgliedschaften
 	if person.UpdateSchulmitgliedschaften || person.UpdateGruppenMitgliedschaften {
 		//Alle Schulmitgliedschaften löschen
-		r := syncSetup.itsl.ReadMembershipsForPerson(person.PersonSyncKey)
-		for _, mem := range r {
-			resp, err := syncSetup.itsl.DeleteMembership(mem.ID)
-			if err != nil {
-				saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
-				ch <- fmt.Sprint(person.Username, insstitutionid, "Update Username", resp)
-				return
-			}
+		resp, err := removeMemberships(ctx, syncSetup, trail, person.PersonSyncKey)
+		if err != nil {
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
+			ch <- fmt.Sprint(person.Username, insstitutionid, "Delete Memberships", resp)
+			return
 		}
 
-		schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person)
+		schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person, toAdmin)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, err)
+			transitionPerson(ctx, syncSetup, person, eventFailed, err)
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Get Schulmitgliedschaften", err)
 			return
 		}
 		log.Println("Schumitgliedschaften:", schulmitgliedschaften)
 
-		/*
-			ÄNDERUNG
-		*/
-		gruppenmitgliedschaften, err := getGruppenmitgliedschaftenWolfsburg(person, syncSetup.db)
-		//gruppenmitgliedschaften, err := getGruppenmitgliedschaften(person)
-
+		gruppenmitgliedschaften, err := getGruppenmitgliedschaften(syncSetup, person, roles)
 		if err != nil {
-			saveUpdatedPersonWithError(syncSetup, person, err)
+			transitionPerson(ctx, syncSetup, person, eventFailed, err)
 			ch <- fmt.Sprint(person.Username, insstitutionid, "Get Gruppenmitgliedschaften", err)
 			return
 		}
@@ -734,19 +1032,20 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 				continue
 			}
 
-			err = checkIfSchoolExist(syncSetup, school)
+			err = checkIfSchoolExist(ctx, syncSetup, school)
 			if err != nil {
-				saveUpdatedPersonWithError(syncSetup, person, err)
+				transitionPerson(ctx, syncSetup, person, eventFailed, err)
 				ch <- person.Username + " Check if School exist " + err.Error()
 				return
 			}
 
-			resp, err := syncSetup.itsl.CreateMembership(school, person.PersonSyncKey, profil)
+			resp, err := syncSetup.itsl.CreateMembership(ctx, school, person.PersonSyncKey, profil)
 			if err != nil {
-				saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+				transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 				ch <- fmt.Sprint(person.Username, insstitutionid, "CreateMembership", resp)
 				return
 			}
+			trail.addMembership(school, profil)
 		}
 
 		for group, school := range gruppenmitgliedschaften {
@@ -754,24 +1053,26 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 				log.Println("Schule ist nicht zu importieren")
 				continue
 			}
-			if makeToAdmin(syncSetup, person) {
+			if toAdmin {
 				log.Println("Make to admin")
 				break
 			}
 			log.Println(group)
-			err = checkIfGroupExist(syncSetup, group, school)
+			err = checkIfGroupExist(ctx, syncSetup, group, school)
 			if err != nil {
-				saveUpdatedPersonWithError(syncSetup, person, err)
+				transitionPerson(ctx, syncSetup, person, eventFailed, err)
 				ch <- fmt.Sprint(person.Username, insstitutionid, "checkIfGroupExist", err)
 				return
 			}
 
-			resp, err := syncSetup.itsl.CreateMembership(group, person.PersonSyncKey, schulmitgliedschaften[school])
+			role := groupRole(syncSetup, person, schulmitgliedschaften, school)
+			resp, err := syncSetup.itsl.CreateMembership(ctx, group, person.PersonSyncKey, role)
 			if err != nil {
-				saveUpdatedPersonWithError(syncSetup, person, errors.New(resp))
+				transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 				ch <- fmt.Sprint(person.Username, insstitutionid, "Create Membership", resp)
 				return
 			}
+			trail.addMembership(group, role)
 		}
 	}
 
@@ -782,7 +1083,7 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 			if syncSetup.UCSSetupSyncDisabled {
 				resp,err := syncSetup.itsl.DeletePerson(person.PersonSyncKey)
 				if err != nil {
-					saveUpdatedPersonWithError(syncSetup,person,errors.New(resp))
+					transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
 					ch <- err.Error()
 					return
 				}
@@ -797,8 +1098,11 @@ func ucsUpdateUser(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPers
 		}
 	*/
 
+	if softDelete != nil {
+		restoreSoftDelete(syncSetup, softDelete)
+	}
 	ch <- fmt.Sprint("Person with Name ", person.Username, " from institution ", insstitutionid, " was updated successfully.")
-	saveUpdatedPersonWithSuccess(syncSetup, person)
+	transitionPerson(ctx, syncSetup, person, eventSucceeded, nil)
 }
 
 // Hilfsfunktionen:
@@ -832,35 +1136,36 @@ func prepareEmail(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerso
 	return email
 }
 
-func prepareFirstname(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) string {
+func prepareFirstname(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles) string {
 	// FIRSTNAME bearbeiten //
 	firstName := person.FirstName
+	profile := siteProfile(syncSetup, person, roles)
 	if person.FirstName == "" {
 		firstName = "NN"
 	}
 	if syncSetup.UCSSetupMakeTeacherFirstnameToOneLetter {
-		if person.Profile == "Staff" {
+		if profile == "Staff" {
 			firstName = firstnameToOneLetter(firstName)
 		}
-		if person.Profile == "Staff" {
+		if profile == "Staff" {
 			firstName = firstnameToOneLetter(firstName)
 		}
 	}
 	if syncSetup.UCSSetupMakeStudentFirstnameToOneLetter {
-		if person.Profile == "Student" {
+		if profile == "Student" {
 			firstName = firstnameToOneLetter(firstName)
 		}
 	}
 	if syncSetup.UCSSetupMakeTeacherFirstnameToOneName {
-		if person.Profile == "Staff" {
+		if profile == "Staff" {
 			firstName = firstnameToOneName(firstName)
 		}
-		if person.Profile == "Administrator" {
+		if profile == "Administrator" {
 			firstName = firstnameToOneName(firstName)
 		}
 	}
 	if syncSetup.UCSSetupMakeStudentFirstnameToOneName {
-		if person.Profile == "Student" {
+		if profile == "Student" {
 			firstName = firstnameToOneName(firstName)
 		}
 	}
@@ -882,37 +1187,44 @@ func prepareLastname(person itswizard_basic.UniventionPerson) string {
 	return lastName
 }
 
-func prepareProfil(person itswizard_basic.UniventionPerson, makeToAdmin bool) string {
+// preparePerson sind die Werte der Person, wie sie an itslearning gesendet werden.
+func preparePerson(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles, toAdmin bool) itswizard_basic.DbPerson15 {
+	return itswizard_basic.DbPerson15{
+		SyncPersonKey: person.PersonSyncKey,
+		FirstName:     prepareFirstname(syncSetup, person, roles),
+		LastName:      prepareLastname(person),
+		Username:      person.Username,
+		Profile:       prepareProfil(syncSetup, person, roles, toAdmin),
+		Email:         prepareEmail(syncSetup, person),
+	}
+}
+
+func prepareProfil(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles, makeToAdmin bool) string {
 	// 1. Person erstellen in itslearning
-	profile := person.Profile
+	profile := siteProfile(syncSetup, person, roles)
 	if makeToAdmin {
 		profile = "Administrator"
 	}
 	return profile
 }
 
+// makeToAdmin entscheidet einmal je Person, ob sie Administrator wird. Mit ApproveAdmins ist dafür eine Freigabe nötig.
 func makeToAdmin(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) bool {
-	//Check #Admin im Lastname
-	makeToAdmin := false
-	if syncSetup.UCSSetupAdminSpecification {
-		for _, lastname := range syncSetup.UCSSetupAdminLastNames {
-			if person.LastName == lastname {
-				makeToAdmin = true
-				return makeToAdmin
-			}
-		}
-
+	makeToAdmin, _ := adminDesignation(syncSetup, person)
+	if makeToAdmin && syncSetup.CrawlerSetup.ApproveAdmins {
+		return adminApproved(syncSetup, person)
 	}
 	return makeToAdmin
-	// ENDE LASTNAME
-
 }
 
-func getSchulmitgliedschaften(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) (schulmitgliedschaften map[string]string, err error) {
+func getSchulmitgliedschaften(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, toAdmin bool) (schulmitgliedschaften map[string]string, err error) {
 	// Kontrolle nach #Admin
 	schulmitgliedschaften = make(map[string]string)
 	err = json.Unmarshal([]byte(person.Schulmitgliedschaften), &schulmitgliedschaften)
-	if makeToAdmin(syncSetup, person) {
+	for school, role := range schulmitgliedschaften {
+		schulmitgliedschaften[school] = syncSetup.RoleMapping.membershipRole(role, school)
+	}
+	if toAdmin {
 		for school, _ := range schulmitgliedschaften {
 			schulmitgliedschaften[school] = "Administrator"
 		}
@@ -920,39 +1232,6 @@ func getSchulmitgliedschaften(syncSetup ucsSyncSetup, person itswizard_basic.Uni
 	return schulmitgliedschaften, err
 }
 
-func getGruppenmitgliedschaftenWolfsburg(person itswizard_basic.UniventionPerson, db *gorm.DB) (gruppenmitgliedschaften map[string]string, err error) {
-	gruppenmitgliedschaften = make(map[string]string)
-	err = json.Unmarshal([]byte(person.GruppenMitgliedschaften), &gruppenmitgliedschaften)
-	if err != nil {
-		return nil, err
-	}
-
-	if person.Profile == "Staff" {
-		var teacherGroupNames []itswizard_basic.UcsTeacherGroupName
-		err = db.Find(&teacherGroupNames).Error
-		if len(teacherGroupNames) == 0 {
-			return gruppenmitgliedschaften, nil
-		}
-		if err != nil {
-			fmt.Println(err)
-			return gruppenmitgliedschaften, err
-		}
-
-		gruppenmitgliedschaftenNeu := make(map[string]string)
-
-		for gruppe, schule := range gruppenmitgliedschaften {
-			for _, v := range teacherGroupNames {
-				if strings.Contains(gruppe, v.Name) {
-					gruppenmitgliedschaftenNeu[gruppe] = schule
-				}
-			}
-		}
-		gruppenmitgliedschaften = gruppenmitgliedschaftenNeu
-	}
-
-	return gruppenmitgliedschaften, err
-}
-
 func isPersonToImport(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, institution_id uint, schulmitgliedschaften map[string]string) bool {
 
 	var isPersonToImport bool
@@ -1087,209 +1366,116 @@ func IsSchoolToImportOuSelect(syncSetup ucsSyncSetup, school string, institution
 
 }
 
-func checkIfSchoolExist(syncSetup ucsSyncSetup, school string) error {
-	//Check if School exist
-	if syncSetup.itsl.ReadGroup(school).Group.Name == "" {
-		resp, err := syncSetup.itsl.CreateGroup(itswizard_basic.DbGroup15{
-			SyncID:        school,
-			Name:          school,
-			ParentGroupID: "0",
-			Level:         0,
-		}, true)
-		if err != nil {
-			return errors.New(resp)
-		}
-	}
-	return nil
+func checkIfSchoolExist(ctx context.Context, syncSetup ucsSyncSetup, school string) error {
+	//Check if School exist, die übergeordneten Ebenen werden mit angelegt
+	return checkIfHierarchyNodeExist(ctx, syncSetup, school)
 }
 
-func checkIfGroupExist(syncSetup ucsSyncSetup, group, school string) error {
-	if syncSetup.itsl.ReadGroup(group).Group.Name == "" {
-		resp, err := syncSetup.itsl.CreateGroup(itswizard_basic.DbGroup15{
+// checkIfGroupExist legt Klassen und Arbeitsgruppen als Gruppe unter der Schule an.
+// Kurse kann der Crawler nicht anlegen, die IMS-ES Anbindung bietet dafür keinen Aufruf.
+func checkIfGroupExist(ctx context.Context, syncSetup ucsSyncSetup, group, school string) error {
+	return syncSetup.Groups.ensure(ctx, group, func() error {
+		name, err := syncSetup.itsl.ReadGroupName(ctx, group)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			return nil
+		}
+		dbGroup := itswizard_basic.DbGroup15{
 			SyncID:        group,
-			Name:          group,
+			Name:          groupName(syncSetup, group, school),
 			ParentGroupID: school,
-			Level:         1,
-		}, false)
+			Level:         syncSetup.Hierarchy.level(school) + 1,
+		}
+		resp, err := syncSetup.itsl.CreateGroup(ctx, dbGroup, false)
 		if err != nil {
 			return errors.New(resp)
 		}
-	}
-	return nil
-}
-
-//Speicherung der Datenbankportationen:
-
-func saveImportedPersonWithError(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, err error) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerimport",
-		Success:     false,
-		Errorstring: err.Error(),
-	})
-
-	person.ToUpdate = false
-	person.ToDelete = false
-	person.Success = false
-	person.Errorstring = err.Error()
-	person.Error = true
-	person.ToImport = true
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
-}
-
-func saveImportedPersonWithSuccess(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerimport",
-		Success:     true,
-		Errorstring: "",
+		registerCreatedGroup(syncSetup, dbGroup, createdGroupKind)
+		return nil
 	})
-
-	person.ToUpdate = false
-	person.ToDelete = false
-	person.Success = true
-	person.Errorstring = ""
-	person.Error = false
-	person.ToImport = false
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
 }
 
-func saveUpdatedPersonWithError(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, err error) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerupdate",
-		Success:     false,
-		Errorstring: err.Error(),
-	})
+// migrated sind die Datenbanken, deren Tabellen in diesem Prozess schon angelegt wurden.
+var migrated = struct {
+	sync.Mutex
+	dbs map[*gorm.DB]bool
+}{dbs: make(map[*gorm.DB]bool)}
 
-	person.ToUpdate = true
-	person.ToDelete = false
-	person.Success = false
-	person.Errorstring = err.Error()
-	person.Error = true
-	person.ToImport = false
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
-}
-
-func saveUpdatedPersonWithSuccess(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerupdate",
-		Success:     true,
-		Errorstring: "",
-	})
-
-	person.ToUpdate = false
-	person.ToDelete = false
-	person.Success = true
-	person.Errorstring = ""
-	person.Error = false
-	person.ToImport = false
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
+// migrateOnce führt die Migration einer Datenbank nur beim ersten Aufruf im Prozess aus.
+func migrateOnce(db *gorm.DB, migrate func(*gorm.DB) error) error {
+	migrated.Lock()
+	defer migrated.Unlock()
+	if migrated.dbs[db] {
+		return nil
+	}
+	err := migrate(db)
+	if err != nil {
+		return err
+	}
+	migrated.dbs[db] = true
+	return nil
 }
 
-func saveDeletedPersonWithError(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, err error) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerlöschung",
-		Success:     false,
-		Errorstring: err.Error(),
-	})
-
-	person.ToUpdate = false
-	person.ToDelete = true
-	person.Success = false
-	person.Errorstring = err.Error()
-	person.Error = true
-	person.ToImport = false
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
+// migrateDatabases legt die Tabellen in der Client Datenbank und in allen Institutionen mit run_person_crawler an.
+func migrateDatabases(allDatabases map[string]*gorm.DB) error {
+	err := migrateOnce(allDatabases["Client"], migrateClientDatabase)
+	if err != nil {
+		return err
+	}
+	var univentionServices []itswizard_basic.UniventionService
+	err = allDatabases["Client"].Where("run_person_crawler = ?", true).Find(&univentionServices).Error
+	if err != nil {
+		return err
+	}
+	for _, service := range univentionServices {
+		db := allDatabases[strconv.Itoa(int(service.InsitutionID))]
+		if db == nil {
+			continue
+		}
+		err = migrateOnce(db, migrateInstitutionDatabase)
+		if err != nil {
+			return errors.Wrap(err, "institution "+strconv.Itoa(int(service.InsitutionID)))
+		}
+	}
+	return nil
 }
 
-func saveDeletedPersonWithSuccess(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) {
-	syncSetup.db.Save(&itswizard_basic.UcsProtokoll{
-		Username:    person.Username,
-		UUID:        person.PersonSyncKey,
-		Action:      "Benutzerlöschung",
-		Success:     true,
-		Errorstring: "",
-	})
-
-	person.ToUpdate = false
-	person.ToDelete = true
-	person.Success = true
-	person.Errorstring = ""
-	person.Error = false
-	person.ToImport = false
-	person.UpdateStammschule = false
-	person.UdpateFirstName = false
-	person.UdpateUsername = false
-	person.UdpateProfile = false
-	person.UdpateProfile = false
-	person.UpdateGruppenMitgliedschaften = false
-	person.UpdateSchulmitgliedschaften = false
-	person.UpdateEmail = false
-	person.UpdateDisable = false
-
-	syncSetup.db.Save(&person)
+// migrateClientDatabase legt die Tabellen des Crawlers in der Client Datenbank an.
+func migrateClientDatabase(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&CrawlerRun{},
+		&CrawlerRunInstitution{},
+		&RunningService{},
+		&CrawlerLease{},
+		&CrawlerAssignment{},
+		&CrawlerRetentionReport{},
+	).Error
 }
 
-type RunningService struct {
-	gorm.Model
-	ServiceName string
-	LastRun     string
+// migrateInstitutionDatabase legt die Tabellen des Crawlers in der Datenbank einer Institution an.
+func migrateInstitutionDatabase(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&UcsRoleMapping{},
+		&UcsAdminRule{},
+		&UcsGroupFilterRule{},
+		&UcsGroupTypePattern{},
+		&UniventionCrawlerSetup{},
+		&UcsHierarchyNode{},
+		&UcsAuditEntry{},
+		&UcsMembershipState{},
+		&UcsDeleteBrake{},
+		&UcsDeleteHold{},
+		&UcsSoftDelete{},
+		&UcsApproval{},
+		&UcsReconcileReport{},
+		&UcsCreatedGroup{},
+		&UcsRolloverMapping{},
+		&UcsRollover{},
+	).Error
+	if err != nil {
+		return err
+	}
+	return backfillMembershipStates(db)
 }
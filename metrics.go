@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "ucs_person_crawler"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	// successRegistry enthält nur die Werte zum letzten erfolgreichen Lauf, gepusht werden sie nur nach einem Erfolg.
+	successRegistry = prometheus.NewRegistry()
+
+	personsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "persons_processed_total",
+		Help:      "Persons processed by institution, action and outcome.",
+	}, []string{"institution", "action", "outcome"})
+
+	imsesCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "imses_call_duration_seconds",
+		Help:      "Latency of IMS-ES calls by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	imsesCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "imses_call_errors_total",
+		Help:      "Failed IMS-ES calls by method.",
+	}, []string{"method"})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Persons waiting in to_import, to_update and to_delete by institution.",
+	}, []string{"institution", "queue"})
+
+	lastSuccessfulRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_run_timestamp_seconds",
+		Help:      "Unix time of the end of the last successful run.",
+	})
+
+	lastSuccessMu sync.Mutex
+	lastSuccess   time.Time
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		personsProcessed,
+		imsesCallDuration,
+		imsesCallErrors,
+		queueDepth,
+	)
+	successRegistry.MustRegister(
+		lastSuccessfulRun,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "seconds_since_last_successful_run",
+			Help:      "Seconds since the end of the last successful run in this process.",
+		}, func() float64 {
+			lastSuccessMu.Lock()
+			defer lastSuccessMu.Unlock()
+			if lastSuccess.IsZero() {
+				return -1
+			}
+			return time.Since(lastSuccess).Seconds()
+		}),
+	)
+}
+
+// observeImsesCall misst die Dauer eines IMS-ES Aufrufs.
+func observeImsesCall(method string, start time.Time, err error) {
+	imsesCallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		imsesCallErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func markRunSuccessful(finished time.Time) {
+	lastSuccessMu.Lock()
+	lastSuccess = finished
+	lastSuccessMu.Unlock()
+	lastSuccessfulRun.Set(float64(finished.Unix()))
+}
+
+// updateQueueDepth zählt die offenen Personen einer Institution.
+func updateQueueDepth(institutionID uint, db *gorm.DB) {
+	institution := strconv.Itoa(int(institutionID))
+	for queue, query := range phaseQueries {
+		var count int
+		err := db.Model(&itswizard_basic.UniventionPerson{}).Where(query).Count(&count).Error
+		if err != nil {
+			log.Println("Queue depth", institution, queue, err)
+			continue
+		}
+		queueDepth.WithLabelValues(institution, "to_"+queue).Set(float64(count))
+	}
+}
+
+// serveMetrics stellt /metrics im Daemon-Modus bereit.
+func serveMetrics(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{metricsRegistry, successRegistry}, promhttp.HandlerOpts{}))
+}
+
+// pushMetrics schickt nach einem einmaligen Lauf den Stand an das Pushgateway aus CRAWLER_PUSHGATEWAY.
+// Die Werte zum letzten erfolgreichen Lauf werden nur nach einem Erfolg geschickt. Add ersetzt nur die geschickten
+// Metriken, nach einem fehlgeschlagenen Lauf behält das Pushgateway deshalb den Zeitpunkt des letzten Erfolgs.
+func pushMetrics() {
+	url := os.Getenv("CRAWLER_PUSHGATEWAY")
+	if url == "" {
+		return
+	}
+	pusher := push.New(url, metricsNamespace).Gatherer(metricsRegistry)
+	lastSuccessMu.Lock()
+	successful := !lastSuccess.IsZero()
+	lastSuccessMu.Unlock()
+	if successful {
+		pusher = pusher.Gatherer(successRegistry)
+	}
+	err := pusher.Add()
+	if err != nil {
+		log.Println("Push metrics:", err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	saveAttempts       = 3
+	saveRetryDelay     = 500 * time.Millisecond
+	defaultJournalPath = "ucs_crawler_journal.jsonl"
+)
+
+// store schreibt in die Datenbank einer Institution. Schreibvorgänge, die auch nach
+// mehreren Versuchen scheitern, landen im Journal und werden im nächsten Lauf nachgeholt.
+type store struct {
+	db            *gorm.DB
+	institutionID uint
+	mu            sync.Mutex
+	failed        bool
+}
+
+func newStore(db *gorm.DB, institutionID uint) *store {
+	return &store{db: db, institutionID: institutionID}
+}
+
+// save speichert alle Werte. Was nicht gespeichert werden kann, wird protokolliert und ins Journal geschrieben.
+// Danach meldet healthy false, damit für die Institution nichts mehr an itslearning übertragen wird.
+func (s *store) save(values ...interface{}) error {
+	var firstErr error
+	for _, value := range values {
+		err := saveWithRetry(s.db, value)
+		if err != nil {
+			s.fail(value, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// savePerson schreibt nur die Aufträge und den Status der Person, siehe savePersonState.
+func (s *store) savePerson(person itswizard_basic.UniventionPerson) error {
+	state := personStateOf(person)
+	err := savePersonState(s.db, state)
+	if err != nil {
+		s.fail(&state, err)
+	}
+	return err
+}
+
+// saveAudit schreibt den Audit-Eintrag mit dem Stand der Mitgliedschaften, siehe saveAuditEntry.
+func (s *store) saveAudit(entry UcsAuditEntry) error {
+	err := saveAuditEntry(s.db, &entry)
+	if err != nil {
+		s.fail(&entry, err)
+	}
+	return err
+}
+
+func (s *store) fail(value interface{}, err error) {
+	s.mu.Lock()
+	s.failed = true
+	s.mu.Unlock()
+	sendLog("Error while saving " + journalTypeName(value) + " of institution " + strconv.Itoa(int(s.institutionID)) + ": " + err.Error())
+	jerr := journal.append(s.institutionID, value, err)
+	if jerr != nil {
+		sendLog("Error while writing journal: " + jerr.Error())
+		log.Println(jerr)
+	}
+}
+
+func (s *store) healthy() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.failed
+}
+
+func saveWithRetry(db *gorm.DB, value interface{}) error {
+	return withRetry(func() error {
+		return db.Save(value).Error
+	})
+}
+
+// withRetry wiederholt f, solange die Datenbank vorübergehend nicht erreichbar ist.
+func withRetry(f func() error) error {
+	var err error
+	for attempt := 0; attempt < saveAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(saveRetryDelay << uint(attempt-1))
+		}
+		err = f()
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+		log.Println("Transient database error, retry:", err)
+	}
+	return err
+}
+
+// isTransientError erkennt Verbindungsabbrüche, Deadlocks und Sperr-Timeouts.
+func isTransientError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		switch mysqlErr.Number {
+		case 1040, 1205, 1213: // too many connections, lock wait timeout, deadlock
+			return true
+		}
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	text := err.Error()
+	return strings.Contains(text, "connection refused") || strings.Contains(text, "broken pipe") || strings.Contains(text, "bad connection")
+}
+
+// journalEntry ist ein nicht gespeicherter Schreibvorgang, eine Zeile im Journal.
+type journalEntry struct {
+	InstitutionID uint            `json:"institution_id"`
+	Type          string          `json:"type"`
+	Value         json.RawMessage `json:"value"`
+	Error         string          `json:"error"`
+	WrittenAt     time.Time       `json:"written_at"`
+}
+
+type journalType struct {
+	new  func() interface{}
+	save func(db *gorm.DB, value interface{}) error
+}
+
+// journalTypes sind die Typen, die ins Journal geschrieben werden können.
+var journalTypes = map[string]journalType{
+	"personState": {
+		new: func() interface{} { return &personState{} },
+		save: func(db *gorm.DB, value interface{}) error {
+			return savePersonState(db, *value.(*personState))
+		},
+	},
+	"UcsProtokoll": {
+		new:  func() interface{} { return &itswizard_basic.UcsProtokoll{} },
+		save: saveWithRetry,
+	},
+	"UcsAuditEntry": {
+		new: func() interface{} { return &UcsAuditEntry{} },
+		save: func(db *gorm.DB, value interface{}) error {
+			return saveAuditEntry(db, value.(*UcsAuditEntry))
+		},
+	},
+	"UcsSoftDelete": {
+		new:  func() interface{} { return &UcsSoftDelete{} },
+		save: saveWithRetry,
+	},
+	"UcsApproval": {
+		new:  func() interface{} { return &UcsApproval{} },
+		save: saveWithRetry,
+	},
+	"UcsReconcileReport": {
+		new:  func() interface{} { return &UcsReconcileReport{} },
+		save: saveWithRetry,
+	},
+	"UcsCreatedGroup": {
+		new:  func() interface{} { return &UcsCreatedGroup{} },
+		save: saveWithRetry,
+	},
+	"UcsRolloverMapping": {
+		new:  func() interface{} { return &UcsRolloverMapping{} },
+		save: saveWithRetry,
+	},
+	"UcsRollover": {
+		new:  func() interface{} { return &UcsRollover{} },
+		save: saveWithRetry,
+	},
+}
+
+func journalTypeName(value interface{}) string {
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+type journalFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+// journal liegt lokal bei der Instanz, der Pfad kommt aus CRAWLER_JOURNAL.
+var journal = &journalFile{path: journalPath()}
+
+func journalPath() string {
+	if path := os.Getenv("CRAWLER_JOURNAL"); path != "" {
+		return path
+	}
+	return defaultJournalPath
+}
+
+func (j *journalFile) append(institutionID uint, value interface{}, saveErr error) error {
+	typeName := journalTypeName(value)
+	if _, ok := journalTypes[typeName]; !ok {
+		return errors.New("type " + typeName + " can not be written to the journal")
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(journalEntry{
+		InstitutionID: institutionID,
+		Type:          typeName,
+		Value:         b,
+		Error:         saveErr.Error(),
+		WrittenAt:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay schreibt die Einträge des Journals in die Datenbanken. Was wieder scheitert, bleibt im Journal.
+func (j *journalFile) replay(allDatabases map[string]*gorm.DB) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var remaining [][]byte
+	replayed, dropped := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var entry journalEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			log.Println("Journal: invalid entry dropped:", err)
+			dropped++
+			continue
+		}
+		jt, ok := journalTypes[entry.Type]
+		if !ok {
+			log.Println("Journal: unknown type", entry.Type, "dropped")
+			dropped++
+			continue
+		}
+		db := allDatabases[strconv.Itoa(int(entry.InstitutionID))]
+		if db == nil {
+			remaining = append(remaining, line)
+			continue
+		}
+		value := jt.new()
+		err = json.Unmarshal(entry.Value, value)
+		if err != nil {
+			log.Println("Journal: invalid", entry.Type, "dropped:", err)
+			dropped++
+			continue
+		}
+		err = jt.save(db, value)
+		if err != nil {
+			log.Println("Journal: replay failed:", err)
+			remaining = append(remaining, line)
+			continue
+		}
+		replayed++
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Das Journal wird über eine temporäre Datei ersetzt, damit kein Eintrag verloren geht.
+	tmp := j.path + ".tmp"
+	var content []byte
+	for _, line := range remaining {
+		content = append(content, line...)
+		content = append(content, '\n')
+	}
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, j.path)
+	if err != nil {
+		return err
+	}
+	if replayed > 0 || dropped > 0 || len(remaining) > 0 {
+		sendLog("Journal replayed: " + strconv.Itoa(replayed) + " saved, " + strconv.Itoa(dropped) + " dropped, " + strconv.Itoa(len(remaining)) + " remaining")
+	}
+	return nil
+}
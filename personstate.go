@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"log"
+	"time"
+)
+
+// personState sind die Spalten, die der Crawler an einer Person ändert, und der Stand, auf dem er gearbeitet hat.
+// Data und die übrigen Spalten gehören dem UCS Listener und werden vom Crawler nicht geschrieben.
+type personState struct {
+	ID        uint                   `json:"id"`
+	Username  string                 `json:"username"`
+	UpdatedAt time.Time              `json:"updated_at"` // updated_at beim Lesen der Person
+	Flags     map[string]interface{} `json:"flags"`
+}
+
+func personStateOf(person itswizard_basic.UniventionPerson) personState {
+	return personState{
+		ID:        person.ID,
+		Username:  person.Username,
+		UpdatedAt: person.UpdatedAt,
+		Flags: map[string]interface{}{
+			"to_import":                       person.ToImport,
+			"to_update":                       person.ToUpdate,
+			"to_delete":                       person.ToDelete,
+			"success":                         person.Success,
+			"error":                           person.Error,
+			"errorstring":                     person.Errorstring,
+			"update_stammschule":              person.UpdateStammschule,
+			"udpate_first_name":               person.UdpateFirstName,
+			"udpate_last_name":                person.UdpateLastName,
+			"udpate_username":                 person.UdpateUsername,
+			"udpate_profile":                  person.UdpateProfile,
+			"update_email":                    person.UpdateEmail,
+			"update_schulmitgliedschaften":    person.UpdateSchulmitgliedschaften,
+			"update_gruppen_mitgliedschaften": person.UpdateGruppenMitgliedschaften,
+			"update_disable":                  person.UpdateDisable,
+		},
+	}
+}
+
+// savePersonState schreibt die Spalten nur, wenn die Person seit dem Lesen nicht geändert wurde.
+// Hat der UCS Listener sie inzwischen geändert, bleibt seine Änderung stehen und die Person
+// wird für einen weiteren Durchlauf markiert.
+func savePersonState(db *gorm.DB, state personState) error {
+	var result *gorm.DB
+	err := withRetry(func() error {
+		result = db.Model(&itswizard_basic.UniventionPerson{}).
+			Where("id = ? and updated_at = ?", state.ID, state.UpdatedAt).
+			Updates(state.Flags)
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	log.Println("Person", state.Username, "was changed during the sync, keep the newer state")
+	return withRetry(func() error {
+		return ensurePersonFlagged(db, state.ID)
+	})
+}
+
+// ensurePersonFlagged markiert eine Person ohne offenen Auftrag für ein vollständiges Update.
+func ensurePersonFlagged(db *gorm.DB, id uint) error {
+	return db.Model(&itswizard_basic.UniventionPerson{}).
+		Where("id = ? and to_import = 0 and to_update = 0 and to_delete = 0", id).
+		Updates(map[string]interface{}{
+			"to_update":                       true,
+			"error":                           false,
+			"udpate_first_name":               true,
+			"udpate_last_name":                true,
+			"udpate_username":                 true,
+			"udpate_profile":                  true,
+			"update_email":                    true,
+			"update_schulmitgliedschaften":    true,
+			"update_gruppen_mitgliedschaften": true,
+		}).Error
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	reconcileBatchSize    = 500
+	reconcileAlertOrphans = 50
+)
+
+// UcsReconcileReport ist das Ergebnis eines Abgleichs aller Personen einer Institution mit itslearning.
+type UcsReconcileReport struct {
+	gorm.Model
+	RunID           string
+	DryRun          bool
+	Checked         int    // abgeglichene Personen
+	Missing         int    // ohne Mitgliedschaften in itslearning, obwohl welche erwartet werden
+	MembershipDrift int    // Anzahl der Mitgliedschaften weicht ab
+	ProfileDrift    int    // zuletzt gesendetes Profil weicht ab
+	ValueDrift      int    // zuletzt gesendete Namen, Benutzername oder E-Mail weichen ab
+	StillPresent    int    // gelöscht, aber noch mit Mitgliedschaften in itslearning
+	Queued          int    // für ein Update oder eine erneute Löschung markiert
+	Orphans         int    // in itslearning angelegt, ohne Person in UCS
+	OrphanKeys      string `sql:"type:text"` // JSON Liste der PersonSyncKeys
+	DurationSeconds float64
+}
+
+// reconcileInterval ist der Abstand der Abgleiche im normalen Lauf, 0: nur mit ucs_crawler reconcile.
+func (s UniventionCrawlerSetup) reconcileInterval() time.Duration {
+	return time.Duration(s.ReconcileIntervalDays) * 24 * time.Hour
+}
+
+// reconcileDue prüft, ob der letzte Abgleich länger als das Intervall her ist.
+func reconcileDue(syncSetup ucsSyncSetup) bool {
+	interval := syncSetup.CrawlerSetup.reconcileInterval()
+	if interval <= 0 {
+		return false
+	}
+	var last UcsReconcileReport
+	err := syncSetup.db.Where("dry_run = ?", false).Last(&last).Error
+	if err != nil {
+		return err.Error() == "record not found"
+	}
+	return time.Since(last.CreatedAt) >= interval
+}
+
+// reconcileInstitution vergleicht jede Person der Institution mit itslearning, unabhängig von ihren Aufträgen.
+// Abweichungen werden als Auftrag markiert und im nächsten Lauf behoben.
+// Über IMS-ES lassen sich nicht alle Personen in itslearning lesen. Als Waisen gelten deshalb Personen,
+// die der Crawler laut UcsProtokoll angelegt und nie gelöscht hat, zu denen es aber keine Person aus UCS mehr gibt.
+func reconcileInstitution(ctx context.Context, syncSetup ucsSyncSetup, dryRun bool) (UcsReconcileReport, error) {
+	start := time.Now()
+	report := UcsReconcileReport{RunID: runIDOf(ctx), DryRun: dryRun}
+
+	lastID := uint(0)
+	for ctx.Err() == nil {
+		var persons []itswizard_basic.UniventionPerson
+		err := syncSetup.db.Where("id > ? and data <> ''", lastID).Order("id").Limit(reconcileBatchSize).Find(&persons).Error
+		if err != nil {
+			return report, err
+		}
+		if len(persons) == 0 {
+			break
+		}
+		for _, person := range persons {
+			lastID = person.ID
+			if ctx.Err() != nil {
+				break
+			}
+			reconcilePerson(ctx, syncSetup, person, &report)
+		}
+	}
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+
+	orphans, err := findOrphans(syncSetup.db)
+	if err != nil {
+		return report, errors.Wrap(err, "orphans")
+	}
+	report.Orphans = len(orphans)
+	b, _ := json.Marshal(orphans)
+	report.OrphanKeys = string(b)
+	report.DurationSeconds = time.Since(start).Seconds()
+
+	institution := strconv.Itoa(int(syncSetup.InstitutionID))
+	summary := fmt.Sprintf("Reconcile institution %s: dry-run=%t checked=%d missing=%d memberships=%d profile=%d values=%d still present=%d queued=%d orphans=%d",
+		institution, dryRun, report.Checked, report.Missing, report.MembershipDrift, report.ProfileDrift, report.ValueDrift,
+		report.StillPresent, report.Queued, report.Orphans)
+	log.Println(summary)
+	if len(orphans) > 0 {
+		if len(orphans) > reconcileAlertOrphans {
+			orphans = orphans[:reconcileAlertOrphans]
+		}
+		summary = summary + ". Orphans: " + strings.Join(orphans, ", ")
+	}
+	if !dryRun {
+		sendLog(summary)
+	}
+	return report, syncSetup.Store.save(&report)
+}
+
+// reconcilePerson gleicht eine Person ab. Nur synchronisierte und gelöschte Personen werden betrachtet,
+// alle anderen haben bereits einen offenen Auftrag.
+func reconcilePerson(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, report *UcsReconcileReport) {
+	state := syncStateOf(person)
+	if state != stateSynced && state != stateDeleted {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, syncSetup.CrawlerSetup.personTimeout())
+	defer cancel()
+	memberships, err := read(ctx, syncSetup.itsl, "ReadMembershipsForPerson", syncSetup.itsl.ReadMembershipsForPerson, person.PersonSyncKey)
+	if err != nil {
+		log.Println("Reconcile", person.Username, err)
+		return
+	}
+	report.Checked++
+
+	if state == stateDeleted {
+		if len(memberships) == 0 {
+			return
+		}
+		report.StillPresent++
+		log.Println("Reconcile", person.Username, "is deleted but has", len(memberships), "memberships")
+		if queueReconcile(syncSetup, person, report, map[string]interface{}{"success": false, "error": false}) {
+			err = expireGracePeriod(syncSetup, person)
+			if err != nil {
+				log.Println("Reconcile", person.Username, err)
+			}
+		}
+		return
+	}
+
+	if strings.Contains(person.Data, `object": null,`) {
+		return
+	}
+	toAdmin := makeToAdmin(syncSetup, person)
+	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person, toAdmin)
+	if err != nil || !isPersonToImport(syncSetup, person, syncSetup.InstitutionID, schulmitgliedschaften) {
+		return
+	}
+	roles := readSchoolRoles(syncSetup, person)
+	expected, err := expectedMemberships(syncSetup, person, roles, schulmitgliedschaften, toAdmin)
+	if err != nil {
+		log.Println("Reconcile", person.Username, err)
+		return
+	}
+
+	drift := false
+	if len(memberships) == 0 && expected > 0 {
+		report.Missing++
+		drift = true
+	} else if len(memberships) != expected {
+		report.MembershipDrift++
+		drift = true
+	}
+
+	var previous auditValues
+	if b := previousValues(syncSetup.db, person.PersonSyncKey); b != "" && json.Unmarshal([]byte(b), &previous) == nil {
+		current := auditValuesOf(preparePerson(syncSetup, person, roles, toAdmin))
+		if previous.Profile != "" && previous.Profile != current.Profile {
+			report.ProfileDrift++
+			drift = true
+		}
+		if previous.FirstName != "" && previous.FirstName != current.FirstName ||
+			previous.LastName != "" && previous.LastName != current.LastName ||
+			previous.Username != "" && previous.Username != current.Username ||
+			previous.Email != "" && previous.Email != current.Email {
+			report.ValueDrift++
+			drift = true
+		}
+	}
+
+	if drift {
+		log.Println("Reconcile", person.Username, "differs from itslearning:", len(memberships), "of", expected, "memberships")
+		queueReconcile(syncSetup, person, report, nil)
+	}
+}
+
+// expectedMemberships zählt die Mitgliedschaften, die ein vollständiges Update anlegen würde.
+func expectedMemberships(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles, schulmitgliedschaften map[string]string, toAdmin bool) (int, error) {
+	gruppenmitgliedschaften, err := getGruppenmitgliedschaften(syncSetup, person, roles)
+	if err != nil {
+		return 0, err
+	}
+	expected := 0
+	for school := range schulmitgliedschaften {
+		if IsSchoolToImportOuSelect(syncSetup, school, syncSetup.InstitutionID) {
+			expected++
+		}
+	}
+	if toAdmin {
+		return expected, nil
+	}
+	for _, school := range gruppenmitgliedschaften {
+		if IsSchoolToImportOuSelect(syncSetup, school, syncSetup.InstitutionID) {
+			expected++
+		}
+	}
+	return expected, nil
+}
+
+// queueReconcile markiert eine synchronisierte Person für ein vollständiges Update oder setzt andere Spalten.
+// Hat der UCS Listener die Person inzwischen geändert, bleibt sie unverändert. Mit columns wird dann false geliefert.
+func queueReconcile(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, report *UcsReconcileReport, columns map[string]interface{}) bool {
+	if report.DryRun {
+		return false
+	}
+	queued := true
+	err := withRetry(func() error {
+		if columns == nil {
+			return ensurePersonFlagged(syncSetup.db.Where("updated_at = ?", person.UpdatedAt), person.ID)
+		}
+		result := syncSetup.db.Model(&itswizard_basic.UniventionPerson{}).
+			Where("id = ? and updated_at = ?", person.ID, person.UpdatedAt).Updates(columns)
+		queued = result.RowsAffected == 1
+		return result.Error
+	})
+	if err != nil {
+		log.Println("Reconcile", person.Username, err)
+		return false
+	}
+	if queued {
+		report.Queued++
+	}
+	return queued
+}
+
+// findOrphans liefert die PersonSyncKeys, die erfolgreich importiert, aber nie gelöscht wurden und keine Person aus UCS mehr haben.
+func findOrphans(db *gorm.DB) ([]string, error) {
+	persons := db.NewScope(&itswizard_basic.UniventionPerson{}).TableName()
+	var orphans []string
+	err := db.Model(&itswizard_basic.UcsProtokoll{}).
+		Where("action = ? and success = ? and uuid not like ?", protocolActions[phaseImport], true, pseudonymPrefix+"%").
+		Where("uuid not in (select person_sync_key from "+persons+" where deleted_at is null)").
+		Where("uuid not in (select uuid from "+db.NewScope(&itswizard_basic.UcsProtokoll{}).TableName()+" where action = ? and success = ?)",
+			protocolActions[phaseDelete], true).
+		Order("uuid").Pluck("distinct uuid", &orphans).Error
+	return orphans, err
+}
+
+// reconcileCommand gleicht Institutionen sofort ab: ucs_crawler reconcile [-institution id] [-dry-run]
+func reconcileCommand(ctx context.Context, allDatabases map[string]*gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "only this institution")
+	dryRun := flags.Bool("dry-run", false, "only report, do not queue corrections")
+	flags.Parse(args)
+
+	err := migrateClientDatabase(allDatabases["Client"])
+	if err != nil {
+		return err
+	}
+	ucsSyncSetupMap, err := loadSyncSetups(allDatabases)
+	if err != nil {
+		return err
+	}
+	if *institutionID != 0 {
+		if _, ok := ucsSyncSetupMap[*institutionID]; !ok {
+			return errors.New("unknown institution " + strconv.Itoa(int(*institutionID)))
+		}
+	}
+	for id, syncSetup := range ucsSyncSetupMap {
+		if *institutionID != 0 && id != *institutionID {
+			continue
+		}
+		report, err := reconcileWithLease(ctx, allDatabases, id, syncSetup, *dryRun)
+		if err != nil {
+			return errors.Wrap(err, "institution "+strconv.Itoa(int(id)))
+		}
+		fmt.Printf("institution %d: checked=%d missing=%d memberships=%d profile=%d values=%d still present=%d queued=%d orphans=%d %s\n",
+			id, report.Checked, report.Missing, report.MembershipDrift, report.ProfileDrift, report.ValueDrift,
+			report.StillPresent, report.Queued, report.Orphans, report.OrphanKeys)
+	}
+	return nil
+}
+
+// reconcileWithLease gleicht eine Institution unter ihrer Sperre ab, damit kein Lauf gleichzeitig Personen markiert.
+func reconcileWithLease(ctx context.Context, allDatabases map[string]*gorm.DB, institutionID uint, syncSetup ucsSyncSetup, dryRun bool) (UcsReconcileReport, error) {
+	leases, err := acquireLeases(allDatabases["Client"], map[uint]ucsSyncSetup{institutionID: syncSetup})
+	if err != nil {
+		return UcsReconcileReport{}, err
+	}
+	defer leases.release()
+	if !leases.holds(institutionID) {
+		return UcsReconcileReport{}, errors.New("another instance holds the lease")
+	}
+	ctx, cancel := leases.context(ctx, institutionID)
+	defer cancel()
+	return reconcileInstitution(ctx, syncSetup, dryRun)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Verfahren nach Ablauf der Aufbewahrungsfrist.
+const (
+	retentionPseudonymise = "pseudonymise" // Personenbezug durch Pseudonyme ersetzen, Einträge bleiben
+	retentionPurge        = "purge"        // Einträge löschen
+)
+
+const (
+	pseudonymPrefix    = "pseudonym-"
+	retentionBatchSize = 500
+)
+
+// CrawlerRetentionReport ist das Ergebnis eines Laufs von ucs_crawler retention in der Client Datenbank.
+type CrawlerRetentionReport struct {
+	gorm.Model
+	InstitutionID    uint
+	Mode             string
+	Cutoff           time.Time
+	DryRun           bool
+	Protocols        int
+	AuditEntries     int
+	DeletedPersons   int
+	DeleteHolds      int
+	SoftDeletes      int
+	Approvals        int
+	ReconcileReports int
+}
+
+// retentionCommand wendet die Aufbewahrungsfristen an: ucs_crawler retention [-institution id] [-dry-run]
+// Betroffen sind UcsProtokoll, UcsAuditEntry, die Daten gelöschter Personen und alle weiteren Tabellen mit Personenbezug,
+// die älter als RetentionDays sind.
+func retentionCommand(allDatabases map[string]*gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "only this institution")
+	dryRun := flags.Bool("dry-run", false, "only count the affected entries")
+	flags.Parse(args)
+
+	dbClient := allDatabases["Client"]
+	err := migrateClientDatabase(dbClient)
+	if err != nil {
+		return err
+	}
+
+	var univentionServices []itswizard_basic.UniventionService
+	query := dbClient.Where("run_person_crawler = ?", true)
+	if *institutionID != 0 {
+		query = query.Where("insitution_id = ?", *institutionID)
+	}
+	err = query.Find(&univentionServices).Error
+	if err != nil {
+		return err
+	}
+
+	for _, service := range univentionServices {
+		db := allDatabases[strconv.Itoa(int(service.InsitutionID))]
+		if db == nil {
+			return errors.New("no database for institution " + strconv.Itoa(int(service.InsitutionID)))
+		}
+		err = migrateInstitutionDatabase(db)
+		if err != nil {
+			return err
+		}
+		var crawlerSetup UniventionCrawlerSetup
+		err = db.Last(&crawlerSetup).Error
+		if err != nil && err.Error() != "record not found" {
+			return err
+		}
+		if crawlerSetup.RetentionDays <= 0 {
+			fmt.Printf("institution %d: no retention configured\n", service.InsitutionID)
+			continue
+		}
+
+		report := CrawlerRetentionReport{
+			InstitutionID: service.InsitutionID,
+			Mode:          crawlerSetup.retentionMode(),
+			Cutoff:        time.Now().AddDate(0, 0, -crawlerSetup.RetentionDays),
+			DryRun:        *dryRun,
+		}
+		err = applyRetention(db, &report)
+		if err != nil {
+			return errors.Wrap(err, "institution "+strconv.Itoa(int(service.InsitutionID)))
+		}
+
+		summary := fmt.Sprintf("Retention institution %d: mode=%s cutoff=%s dry-run=%t protocols=%d audit=%d deleted persons=%d "+
+			"delete holds=%d soft deletes=%d approvals=%d reconcile reports=%d",
+			report.InstitutionID, report.Mode, report.Cutoff.Format(time.RFC3339), report.DryRun,
+			report.Protocols, report.AuditEntries, report.DeletedPersons,
+			report.DeleteHolds, report.SoftDeletes, report.Approvals, report.ReconcileReports)
+		fmt.Println(summary)
+		if !*dryRun {
+			sendLog(summary)
+			err = dbClient.Save(&report).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s UniventionCrawlerSetup) retentionMode() string {
+	if s.RetentionMode == retentionPurge {
+		return retentionPurge
+	}
+	return retentionPseudonymise
+}
+
+// pseudonym ist für denselben Wert immer gleich, ohne Schlüssel aber nicht zurückzurechnen.
+func pseudonym(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func applyRetention(db *gorm.DB, report *CrawlerRetentionReport) error {
+	var key []byte
+	if report.Mode == retentionPseudonymise {
+		key = []byte(os.Getenv("CRAWLER_PSEUDONYM_KEY"))
+		if len(key) == 0 && !report.DryRun {
+			return errors.New("CRAWLER_PSEUDONYM_KEY is not set")
+		}
+	}
+
+	var err error
+	report.Protocols, err = retainProtocols(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsProtokoll")
+	}
+	report.AuditEntries, err = retainAuditEntries(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsAuditEntry")
+	}
+	report.DeletedPersons, err = retainDeletedPersons(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UniventionPerson")
+	}
+	report.DeleteHolds, err = retainDeleteHolds(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsDeleteHold")
+	}
+	report.SoftDeletes, err = retainSoftDeletes(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsSoftDelete")
+	}
+	report.Approvals, err = retainApprovals(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsApproval")
+	}
+	report.ReconcileReports, err = retainReconcileReports(db, report, key)
+	if err != nil {
+		return errors.Wrap(err, "UcsReconcileReport")
+	}
+	return nil
+}
+
+// retainRows zählt, löscht oder pseudonymisiert die Einträge aus query. Beim Pseudonymisieren muss query
+// die schon pseudonymisierten Einträge auslassen, columns liefert die ID und die neuen Spalten eines Eintrags.
+func retainRows[T any](db *gorm.DB, report *CrawlerRetentionReport, query *gorm.DB, columns func(T) (uint, map[string]interface{})) (int, error) {
+	var model T
+	if report.DryRun {
+		count := 0
+		err := query.Count(&count).Error
+		return count, err
+	}
+	if report.Mode == retentionPurge {
+		result := query.Delete(&model)
+		return int(result.RowsAffected), result.Error
+	}
+
+	count := 0
+	for {
+		var rows []T
+		err := query.Limit(retentionBatchSize).Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return count, err
+		}
+		for _, row := range rows {
+			id, values := columns(row)
+			err = db.Model(&model).Unscoped().Where("id = ?", id).UpdateColumns(values).Error
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+func retainDeleteHolds(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&UcsDeleteHold{}).Unscoped().Where("created_at < ?", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("person_sync_key not like ?", pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(hold UcsDeleteHold) (uint, map[string]interface{}) {
+		return hold.ID, map[string]interface{}{
+			"person_sync_key": pseudonym(key, hold.PersonSyncKey),
+			"username":        pseudonym(key, hold.Username),
+		}
+	})
+}
+
+// retainSoftDeletes betrifft nur beendete Schonfristen, laufende werden für die Löschung noch gebraucht.
+func retainSoftDeletes(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&UcsSoftDelete{}).Unscoped().Where("created_at < ? and (restored = 1 or deleted = 1)", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("person_sync_key not like ?", pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(softDelete UcsSoftDelete) (uint, map[string]interface{}) {
+		return softDelete.ID, map[string]interface{}{
+			"person_sync_key": pseudonym(key, softDelete.PersonSyncKey),
+			"username":        pseudonym(key, softDelete.Username),
+		}
+	})
+}
+
+// retainApprovals betrifft nur umgesetzte Freigaben. Offene Freigaben und die Freigabe als Administrator gelten weiter.
+// Der Grund kann Namen aus den Admin-Regeln enthalten und wird geleert.
+func retainApprovals(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&UcsApproval{}).Unscoped().Where("created_at < ? and done = 1", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("person_sync_key not like ?", pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(approval UcsApproval) (uint, map[string]interface{}) {
+		return approval.ID, map[string]interface{}{
+			"person_sync_key": pseudonym(key, approval.PersonSyncKey),
+			"username":        pseudonym(key, approval.Username),
+			"reason":          "",
+		}
+	})
+}
+
+// retainReconcileReports betrifft nur die Liste der Waisen, die Zahlen bleiben beim Pseudonymisieren erhalten.
+func retainReconcileReports(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&UcsReconcileReport{}).Unscoped().Where("created_at < ?", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("orphan_keys not in ('', 'null', '[]') and orphan_keys not like ?", `["`+pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(reconcile UcsReconcileReport) (uint, map[string]interface{}) {
+		var orphans []string
+		if json.Unmarshal([]byte(reconcile.OrphanKeys), &orphans) != nil {
+			return reconcile.ID, map[string]interface{}{"orphan_keys": ""}
+		}
+		for i, orphan := range orphans {
+			orphans[i] = pseudonym(key, orphan)
+		}
+		b, _ := json.Marshal(orphans)
+		return reconcile.ID, map[string]interface{}{"orphan_keys": string(b)}
+	})
+}
+
+// retainProtocols leert auch den Fehlertext, er kann Namen und Werte der Person enthalten.
+func retainProtocols(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&itswizard_basic.UcsProtokoll{}).Unscoped().Where("created_at < ?", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("username not like ?", pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(protocol itswizard_basic.UcsProtokoll) (uint, map[string]interface{}) {
+		return protocol.ID, map[string]interface{}{
+			"username":    pseudonym(key, protocol.Username),
+			"uuid":        pseudonym(key, protocol.UUID),
+			"errorstring": "",
+		}
+	})
+}
+
+// retainAuditEntries betrifft alle Einträge. Die Mitgliedschaften, die der Crawler für eine Person hält,
+// stehen in UcsMembershipState und bleiben erhalten.
+func retainAuditEntries(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&UcsAuditEntry{}).Unscoped().Where("created_at < ?", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("person_sync_key not like ?", pseudonymPrefix+"%")
+	}
+	// Gesendete Werte, Fehlertexte und Mitgliedschaften können die Person erkennbar machen und werden geleert,
+	// Aktionen und Zustände bleiben.
+	return retainRows(db, report, query, func(entry UcsAuditEntry) (uint, map[string]interface{}) {
+		return entry.ID, map[string]interface{}{
+			"person_sync_key":     pseudonym(key, entry.PersonSyncKey),
+			"username":            pseudonym(key, entry.Username),
+			"errorstring":         "",
+			"previous":            "",
+			"sent":                "",
+			"memberships_added":   "",
+			"memberships_removed": "",
+			"trigger":             "",
+		}
+	})
+}
+
+// retainDeletedPersons betrifft nur Personen, die in itslearning gelöscht wurden.
+// Der PersonSyncKey bleibt, damit eine wieder angelegte Person erkannt wird.
+func retainDeletedPersons(db *gorm.DB, report *CrawlerRetentionReport, key []byte) (int, error) {
+	query := db.Model(&itswizard_basic.UniventionPerson{}).Unscoped().
+		Where("to_delete = 1 and success = 1 and updated_at < ?", report.Cutoff)
+	if report.Mode == retentionPseudonymise {
+		query = query.Where("username not like ?", pseudonymPrefix+"%")
+	}
+	return retainRows(db, report, query, func(person itswizard_basic.UniventionPerson) (uint, map[string]interface{}) {
+		return person.ID, map[string]interface{}{
+			"username":                 pseudonym(key, person.Username),
+			"first_name":               "",
+			"last_name":                "",
+			"email":                    "",
+			"data":                     "",
+			"schulmitgliedschaften":    "",
+			"gruppen_mitgliedschaften": "",
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"log"
+	"sort"
+)
+
+// ucsRoleDefault ist die UCS-Rolle, die für alle nicht zugeordneten Rollen gilt.
+const ucsRoleDefault = "*"
+
+// UcsRoleMapping ordnet eine UCS-Rolle (z.B. teacher, staff, school_admin, student)
+// einem itslearning Seitenprofil und einer Mitgliedschaftsrolle zu.
+// Ist School gesetzt, gilt die Zuordnung nur für diese Schule und überschreibt die allgemeine.
+type UcsRoleMapping struct {
+	gorm.Model
+	UcsRole        string
+	School         string
+	SiteProfile    string
+	MembershipRole string
+	Rank           int // Rang des Seitenprofils für primaryProfileHighest, höher gewinnt. 0: ohne Rang
+}
+
+type roleMapping map[string]UcsRoleMapping
+
+func roleMappingKey(school, ucsRole string) string {
+	return school + "|" + ucsRole
+}
+
+func newRoleMapping(mappings []UcsRoleMapping) roleMapping {
+	m := make(roleMapping)
+	for _, mapping := range mappings {
+		m[roleMappingKey(mapping.School, mapping.UcsRole)] = mapping
+	}
+	return m
+}
+
+// lookup sucht zuerst nach der Schule, dann allgemein und zuletzt nach dem Standard.
+func (m roleMapping) lookup(ucsRole, school string) (UcsRoleMapping, bool) {
+	for _, key := range []string{
+		roleMappingKey(school, ucsRole),
+		roleMappingKey("", ucsRole),
+		roleMappingKey(school, ucsRoleDefault),
+		roleMappingKey("", ucsRoleDefault),
+	} {
+		if mapping, ok := m[key]; ok {
+			return mapping, true
+		}
+	}
+	return UcsRoleMapping{}, false
+}
+
+// siteProfile liefert das itslearning Profil. Ohne Zuordnung wird die UCS-Rolle übernommen.
+func (m roleMapping) siteProfile(ucsRole string) string {
+	mapping, ok := m.lookup(ucsRole, "")
+	if !ok || mapping.SiteProfile == "" {
+		return ucsRole
+	}
+	return mapping.SiteProfile
+}
+
+// membershipRole liefert die Rolle für die Mitgliedschaft in einer Schule.
+func (m roleMapping) membershipRole(ucsRole, school string) string {
+	mapping, ok := m.lookup(ucsRole, school)
+	if !ok || mapping.MembershipRole == "" {
+		return ucsRole
+	}
+	return mapping.MembershipRole
+}
+
+// schoolSiteProfile liefert das Profil für eine Rolle an einer Schule.
+func (m roleMapping) schoolSiteProfile(ucsRole, school string) string {
+	mapping, ok := m.lookup(ucsRole, school)
+	if !ok || mapping.SiteProfile == "" {
+		return ucsRole
+	}
+	return mapping.SiteProfile
+}
+
+// profileRank ist der höchste Rang, den die Zuordnungen dem Profil geben. Profile ohne Rang stehen ganz unten.
+func (m roleMapping) profileRank(profile string) int {
+	rank := 0
+	for _, mapping := range m {
+		if mapping.SiteProfile == profile && mapping.Rank > rank {
+			rank = mapping.Rank
+		}
+	}
+	return rank
+}
+
+// Auswahl des Seitenprofils einer Person mit Rollen an mehreren Schulen.
+const (
+	primaryProfileUcs     = "ucs"     // das Profil aus UCS
+	primaryProfileHighest = "highest" // das Profil mit dem höchsten Rang aller Schulen, z.B. Staff vor Student
+	primaryProfileFirst   = "first"   // das Profil der ersten Schule nach ihrer Kennung
+)
+
+// adminProfile wird nie aus den Rollen an den Schulen übernommen. Administrator wird eine Person nur
+// über ihr Profil aus UCS oder über die Admin-Regeln, die mit ApproveAdmins eine Freigabe brauchen.
+const adminProfile = "Administrator"
+
+func (s UniventionCrawlerSetup) primaryProfilePolicy() string {
+	switch s.PrimaryProfilePolicy {
+	case primaryProfileHighest, primaryProfileFirst:
+		return s.PrimaryProfilePolicy
+	}
+	return primaryProfileUcs
+}
+
+// ucsSchoolRoles sind die UCS-Rollen der Person je Schule.
+func ucsSchoolRoles(person itswizard_basic.UniventionPerson) (map[string]string, error) {
+	roles := make(map[string]string)
+	err := json.Unmarshal([]byte(person.Schulmitgliedschaften), &roles)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// schoolRoles sind die UCS-Rollen einer Person je Schule, einmal je Person gelesen.
+type schoolRoles struct {
+	roles map[string]string // nil, wenn die Schulmitgliedschaften nicht lesbar sind
+	first string            // erste Schule aus der OU-Auswahl nach ihrer Kennung, nur bei primaryProfileFirst
+}
+
+// readSchoolRoles liest die Rollen der Person und meldet nicht lesbare Schulmitgliedschaften einmal.
+func readSchoolRoles(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) schoolRoles {
+	roles, err := ucsSchoolRoles(person)
+	if err != nil {
+		log.Println("Person", person.Username, "Schulmitgliedschaften:", err)
+		return schoolRoles{}
+	}
+	if syncSetup.CrawlerSetup.primaryProfilePolicy() != primaryProfileFirst {
+		return schoolRoles{roles: roles}
+	}
+	return schoolRoles{roles: roles, first: firstSchool(roles, func(school string) bool {
+		return IsSchoolToImportOuSelect(syncSetup, school, syncSetup.InstitutionID)
+	})}
+}
+
+// firstSchool ist die erste Schule nach ihrer Kennung, die übertragen wird.
+func firstSchool(roles map[string]string, imported func(school string) bool) string {
+	var schools []string
+	for school := range roles {
+		schools = append(schools, school)
+	}
+	sort.Strings(schools)
+	for _, school := range schools {
+		if imported(school) {
+			return school
+		}
+	}
+	return ""
+}
+
+// siteProfile liefert das zugeordnete Profil der Person ohne Admin-Kennzeichnung.
+// Bei primaryProfileHighest gewinnt das Profil ihrer Schulen mit dem höchsten Rang, wenn er über dem Profil aus UCS liegt.
+// Bei primaryProfileFirst gilt das Profil der ersten übertragenen Schule. Sind die Schulen nicht lesbar, gilt das Profil aus UCS.
+func siteProfile(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles) string {
+	profile := syncSetup.RoleMapping.siteProfile(person.Profile)
+	switch syncSetup.CrawlerSetup.primaryProfilePolicy() {
+	case primaryProfileFirst:
+		if roles.first != "" {
+			if schoolProfile := syncSetup.RoleMapping.schoolSiteProfile(roles.roles[roles.first], roles.first); schoolProfile != adminProfile {
+				profile = schoolProfile
+			}
+		}
+	case primaryProfileHighest:
+		rank := syncSetup.RoleMapping.profileRank(profile)
+		for school, role := range roles.roles {
+			schoolProfile := syncSetup.RoleMapping.schoolSiteProfile(role, school)
+			if schoolProfile == adminProfile {
+				continue
+			}
+			if schoolRank := syncSetup.RoleMapping.profileRank(schoolProfile); schoolRank > rank {
+				profile = schoolProfile
+				rank = schoolRank
+			}
+		}
+	}
+	return profile
+}
+
+// schoolProfile ist das Profil der Person an einer Schule. Ohne Rolle an der Schule gilt ihr Seitenprofil.
+func schoolProfile(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, roles schoolRoles, school string) string {
+	if role, ok := roles.roles[school]; ok {
+		return syncSetup.RoleMapping.schoolSiteProfile(role, school)
+	}
+	return siteProfile(syncSetup, person, roles)
+}
+
+// groupRole ist die Rolle in einer Gruppe: die Rolle der Person an der Schule der Gruppe.
+// Ist sie dort kein Mitglied, gilt die Rolle ihres Profils aus UCS an dieser Schule.
+func groupRole(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, schulmitgliedschaften map[string]string, school string) string {
+	if role := schulmitgliedschaften[school]; role != "" {
+		return role
+	}
+	return syncSetup.RoleMapping.membershipRole(person.Profile, school)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/itslearninggermany/itswizard_basic"
+	"testing"
+)
+
+func testRoleSetup(policy string) ucsSyncSetup {
+	return ucsSyncSetup{
+		CrawlerSetup: UniventionCrawlerSetup{PrimaryProfilePolicy: policy},
+		RoleMapping: newRoleMapping([]UcsRoleMapping{
+			{UcsRole: "teacher", SiteProfile: "Staff", MembershipRole: "Instructor", Rank: 3},
+			{UcsRole: "student", SiteProfile: "Student", MembershipRole: "Learner", Rank: 2},
+			{UcsRole: "school_admin", SiteProfile: "Administrator", MembershipRole: "Administrator", Rank: 4},
+			{UcsRole: "student", School: "schoolC", SiteProfile: "Guest", MembershipRole: "Guest", Rank: 1},
+		}),
+	}
+}
+
+func testPerson(profile, schulmitgliedschaften string) itswizard_basic.UniventionPerson {
+	return itswizard_basic.UniventionPerson{
+		Username:              "test",
+		Profile:               profile,
+		Schulmitgliedschaften: schulmitgliedschaften,
+	}
+}
+
+// testSchoolRoles liest die Rollen wie readSchoolRoles, aber ohne OU-Auswahl.
+func testSchoolRoles(setup ucsSyncSetup, person itswizard_basic.UniventionPerson) schoolRoles {
+	roles, err := ucsSchoolRoles(person)
+	if err != nil {
+		return schoolRoles{}
+	}
+	if setup.CrawlerSetup.primaryProfilePolicy() != primaryProfileFirst {
+		return schoolRoles{roles: roles}
+	}
+	return schoolRoles{roles: roles, first: firstSchool(roles, func(string) bool { return true })}
+}
+
+func TestSiteProfile(t *testing.T) {
+	teacherAStudentB := `{"schoolA": "teacher", "schoolB": "student"}`
+	studentATeacherB := `{"schoolA": "student", "schoolB": "teacher"}`
+	tests := []struct {
+		name    string
+		policy  string
+		profile string
+		schools string
+		want    string
+	}{
+		{"ucs keeps the UCS profile", primaryProfileUcs, "student", teacherAStudentB, "Student"},
+		{"unknown policy is ucs", "other", "student", teacherAStudentB, "Student"},
+		{"highest takes the teacher role", primaryProfileHighest, "student", teacherAStudentB, "Staff"},
+		{"highest keeps a higher UCS profile", primaryProfileHighest, "teacher", `{"schoolA": "student"}`, "Staff"},
+		{"first takes the first school", primaryProfileFirst, "student", teacherAStudentB, "Staff"},
+		{"first takes the first school as student", primaryProfileFirst, "teacher", studentATeacherB, "Student"},
+		{"first without schools keeps the UCS profile", primaryProfileFirst, "teacher", `{}`, "Staff"},
+		{"unmapped UCS profile is passed through", primaryProfileUcs, "guardian", `{"schoolA": "guardian"}`, "guardian"},
+		{"highest ranks an unmapped UCS profile lowest", primaryProfileHighest, "guardian", teacherAStudentB, "Staff"},
+		{"highest ignores unmapped school roles", primaryProfileHighest, "student", `{"schoolA": "guardian"}`, "Student"},
+		{"highest never takes Administrator from a school", primaryProfileHighest, "student", `{"schoolA": "student", "schoolB": "school_admin"}`, "Student"},
+		{"first never takes Administrator from a school", primaryProfileFirst, "student", `{"schoolA": "school_admin"}`, "Student"},
+		{"highest with malformed schools keeps the UCS profile", primaryProfileHighest, "student", `{"schoolA": `, "Student"},
+		{"first with malformed schools keeps the UCS profile", primaryProfileFirst, "student", `["schoolA"]`, "Student"},
+	}
+	for _, test := range tests {
+		setup, person := testRoleSetup(test.policy), testPerson(test.profile, test.schools)
+		got := siteProfile(setup, person, testSchoolRoles(setup, person))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSiteProfileRankFromMapping(t *testing.T) {
+	setup := testRoleSetup(primaryProfileHighest)
+	setup.RoleMapping = newRoleMapping([]UcsRoleMapping{
+		{UcsRole: "teacher", SiteProfile: "Staff", Rank: 1},
+		{UcsRole: "student", SiteProfile: "Student", Rank: 2},
+	})
+	person := testPerson("teacher", `{"schoolA": "teacher", "schoolB": "student"}`)
+	got := siteProfile(setup, person, testSchoolRoles(setup, person))
+	if got != "Student" {
+		t.Errorf("got %q, want the profile with the configured higher rank", got)
+	}
+}
+
+func TestFirstSchool(t *testing.T) {
+	roles := map[string]string{"schoolA": "teacher", "schoolB": "student", "schoolC": "student"}
+	tests := []struct {
+		name     string
+		imported map[string]bool
+		want     string
+	}{
+		{"all schools are imported", map[string]bool{"schoolA": true, "schoolB": true, "schoolC": true}, "schoolA"},
+		{"first school is outside the OU selection", map[string]bool{"schoolB": true, "schoolC": true}, "schoolB"},
+		{"no school is imported", map[string]bool{}, ""},
+	}
+	for _, test := range tests {
+		got := firstSchool(roles, func(school string) bool { return test.imported[school] })
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSiteProfileFirstImportedSchool(t *testing.T) {
+	setup := testRoleSetup(primaryProfileFirst)
+	person := testPerson("student", `{"schoolA": "teacher", "schoolB": "student"}`)
+	roles, _ := ucsSchoolRoles(person)
+	got := siteProfile(setup, person, schoolRoles{roles: roles, first: "schoolB"})
+	if got != "Student" {
+		t.Errorf("got %q, want the profile of the first school in the OU selection", got)
+	}
+	got = siteProfile(setup, testPerson("teacher", `{"schoolA": "student"}`), schoolRoles{roles: map[string]string{"schoolA": "student"}})
+	if got != "Staff" {
+		t.Errorf("got %q, want the UCS profile without an imported school", got)
+	}
+}
+
+func TestSchoolProfile(t *testing.T) {
+	teacherAStudentB := `{"schoolA": "teacher", "schoolB": "student", "schoolC": "student"}`
+	tests := []struct {
+		name    string
+		policy  string
+		profile string
+		schools string
+		school  string
+		want    string
+	}{
+		{"teacher at school A", primaryProfileHighest, "student", teacherAStudentB, "schoolA", "Staff"},
+		{"student at school B", primaryProfileHighest, "student", teacherAStudentB, "schoolB", "Student"},
+		{"school mapping overrides the general one", primaryProfileHighest, "student", teacherAStudentB, "schoolC", "Guest"},
+		{"student at school B with first school", primaryProfileFirst, "student", teacherAStudentB, "schoolB", "Student"},
+		{"other school takes the site profile", primaryProfileHighest, "student", teacherAStudentB, "schoolD", "Staff"},
+		{"other school with first school", primaryProfileFirst, "student", teacherAStudentB, "schoolD", "Staff"},
+		{"unmapped school role is passed through", primaryProfileUcs, "student", `{"schoolA": "guardian"}`, "schoolA", "guardian"},
+		{"malformed schools take the site profile", primaryProfileHighest, "teacher", `{`, "schoolA", "Staff"},
+	}
+	for _, test := range tests {
+		setup, person := testRoleSetup(test.policy), testPerson(test.profile, test.schools)
+		got := schoolProfile(setup, person, testSchoolRoles(setup, person), test.school)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGroupRole(t *testing.T) {
+	tests := []struct {
+		name                  string
+		profile               string
+		schulmitgliedschaften map[string]string
+		school                string
+		want                  string
+	}{
+		{"role at the school of the group", "student", map[string]string{"schoolA": "Instructor", "schoolB": "Learner"}, "schoolA", "Instructor"},
+		{"student role at the other school", "student", map[string]string{"schoolA": "Instructor", "schoolB": "Learner"}, "schoolB", "Learner"},
+		{"no membership takes the UCS profile", "teacher", map[string]string{"schoolB": "Learner"}, "schoolA", "Instructor"},
+		{"no membership with school mapping", "student", map[string]string{}, "schoolC", "Guest"},
+		{"unmapped UCS profile is passed through", "guardian", map[string]string{}, "schoolA", "guardian"},
+		{"empty role takes the UCS profile", "student", map[string]string{"schoolA": ""}, "schoolA", "Learner"},
+	}
+	for _, test := range tests {
+		got := groupRole(testRoleSetup(primaryProfileHighest), testPerson(test.profile, ""), test.schulmitgliedschaften, test.school)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUcsSchoolRoles(t *testing.T) {
+	tests := []struct {
+		name    string
+		schools string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"two schools", `{"schoolA": "teacher", "schoolB": "student"}`, map[string]string{"schoolA": "teacher", "schoolB": "student"}, false},
+		{"no schools", `{}`, map[string]string{}, false},
+		{"empty", ``, nil, true},
+		{"truncated", `{"schoolA": `, nil, true},
+		{"list instead of object", `["schoolA"]`, nil, true},
+		{"role is not a string", `{"schoolA": 1}`, nil, true},
+	}
+	for _, test := range tests {
+		got, err := ucsSchoolRoles(testPerson("", test.schools))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for school, role := range test.want {
+			if got[school] != role {
+				t.Errorf("%s: school %s got %q, want %q", test.name, school, got[school], role)
+			}
+		}
+	}
+}
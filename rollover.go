@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rolloverBatchSize = 500
+
+// UcsRolloverMapping ordnet eine Gruppe des alten Schuljahres der Gruppe des neuen zu, z.B. schule-5a -> schule-6a.
+// Solange es offene Zuordnungen gibt, werden die Updates der Institution angehalten, damit die Umbenennung in UCS
+// nicht als Einzelupdates übertragen wird. Zuordnungen werden deshalb erst kurz vor dem Wechsel angelegt.
+// Die alten Gruppen bleiben mit ihren Mitgliedschaften an ihrem Platz. Angelegte Gruppen archiviert die Bereinigung
+// der Gruppen, sobald sie keine Mitgliedschaften mehr haben, siehe cleanupGroups.
+type UcsRolloverMapping struct {
+	gorm.Model
+	OldSyncID     string
+	NewSyncID     string
+	School        string
+	Done          bool
+	UcsRolloverID uint // Wechsel, in dem die Zuordnung umgesetzt wurde
+}
+
+// UcsRollover ist ein Schuljahreswechsel einer Institution.
+type UcsRollover struct {
+	gorm.Model
+	RunID       string
+	StartedBy   string
+	DryRun      bool
+	Mappings    int
+	Persons     int // Personen, deren Änderung vollständig durch die Zuordnungen erklärt ist
+	Memberships int // angelegte Mitgliedschaften in den neuen Gruppen
+	Remaining   int // Personen mit weiteren Änderungen oder ohne Audit-Eintrag, sie werden danach normal aktualisiert
+	Errors      int
+	FinishedAt  *time.Time
+}
+
+// rolloverPending meldet offene Zuordnungen. Dann bleibt die Update-Phase der Institution angehalten.
+func rolloverPending(syncSetup ucsSyncSetup) bool {
+	count := 0
+	err := syncSetup.db.Model(&UcsRolloverMapping{}).Where("done = ?", false).Count(&count).Error
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return count > 0
+}
+
+// runRollover setzt alle offenen Zuordnungen einer Institution in einem Durchgang um:
+// 1. die neuen Gruppen werden angelegt,
+// 2. Personen, deren Änderung nur aus dem Wechsel besteht, werden zusätzlich Mitglied der neuen Gruppe,
+// ihre alten Mitgliedschaften bleiben als Verlauf erhalten,
+// 3. die alten Gruppen bleiben oder werden archiviert.
+// Personen mit weiteren Änderungen bleiben markiert und werden im nächsten Lauf wie bisher aktualisiert.
+func runRollover(ctx context.Context, syncSetup ucsSyncSetup, rollover *UcsRollover) error {
+	var mappings []UcsRolloverMapping
+	err := syncSetup.db.Where("done = ?", false).Find(&mappings).Error
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return errors.New("no open rollover mappings")
+	}
+	rollover.Mappings = len(mappings)
+	newToOld := make(map[string]string)
+	for _, mapping := range mappings {
+		newToOld[mapping.NewSyncID] = mapping.OldSyncID
+	}
+
+	if !rollover.DryRun {
+		err = syncSetup.Store.save(rollover)
+		if err != nil {
+			return err
+		}
+		for _, mapping := range mappings {
+			err = checkIfSchoolExist(ctx, syncSetup, mapping.School)
+			if err == nil {
+				err = checkIfGroupExist(ctx, syncSetup, mapping.NewSyncID, mapping.School)
+			}
+			if err != nil {
+				return errors.Wrap(err, "group "+mapping.NewSyncID)
+			}
+		}
+	}
+
+	lastID := uint(0)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var persons []itswizard_basic.UniventionPerson
+		err = syncSetup.db.Where("id > ? and "+phaseQueries[phaseUpdate]+" and to_import = 0 and data <> ''", lastID).
+			Order("id").Limit(rolloverBatchSize).Find(&persons).Error
+		if err != nil {
+			return err
+		}
+		if len(persons) == 0 {
+			break
+		}
+		for _, person := range persons {
+			lastID = person.ID
+			rolloverPerson(ctx, syncSetup, person, newToOld, rollover)
+		}
+	}
+
+	for _, mapping := range mappings {
+		if !rollover.DryRun {
+			mapping.Done = true
+			mapping.UcsRolloverID = rollover.ID
+			syncSetup.Store.save(&mapping)
+		}
+	}
+	return nil
+}
+
+// rolloverPerson überträgt den Wechsel einer Person, wenn ihre offene Änderung nur aus den Zuordnungen besteht.
+func rolloverPerson(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, newToOld map[string]string, rollover *UcsRollover) {
+	toAdmin := makeToAdmin(syncSetup, person)
+	schulmitgliedschaften, err := getSchulmitgliedschaften(syncSetup, person, toAdmin)
+	if err != nil {
+		return
+	}
+	current, err := getGruppenmitgliedschaften(syncSetup, person, readSchoolRoles(syncSetup, person))
+	if err != nil {
+		return
+	}
+	moved := make(map[string]string) // neue Gruppe -> Schule
+	for group, school := range current {
+		if _, ok := newToOld[group]; ok {
+			moved[group] = school
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+
+	// Ohne Audit-Eintrag ist der alte Stand unbekannt. Die Person wird dann nicht geraten, sondern normal aktualisiert.
+	previous := previousGroups(syncSetup.db, person.PersonSyncKey, schulmitgliedschaften)
+	covered := previous != nil && !person.UdpateFirstName && !person.UdpateLastName && !person.UdpateUsername && !person.UdpateProfile &&
+		!person.UpdateEmail && !person.UpdateSchulmitgliedschaften
+	oldToNew := make(map[string]string)
+	for group := range moved {
+		oldToNew[newToOld[group]] = group
+		if !previous[newToOld[group]] {
+			covered = false
+		}
+	}
+	for group := range current {
+		if _, ok := moved[group]; !ok && !previous[group] {
+			covered = false
+		}
+	}
+	for group := range previous {
+		if _, ok := current[group]; !ok && oldToNew[group] == "" {
+			covered = false
+		}
+	}
+	if !covered {
+		rollover.Remaining++
+		return
+	}
+	if rollover.DryRun {
+		rollover.Persons++
+		rollover.Memberships += len(moved)
+		return
+	}
+
+	if !lockUser(person.PersonSyncKey) {
+		rollover.Remaining++
+		return
+	}
+	defer unlockUser(person.PersonSyncKey)
+	rollover.Persons++
+	rollover.Memberships += len(moved)
+	ctx, cancel := context.WithTimeout(ctx, syncSetup.CrawlerSetup.personTimeout())
+	defer cancel()
+	ctx, trail := startAudit(ctx)
+	for group, school := range moved {
+		if !IsSchoolToImportOuSelect(syncSetup, school, syncSetup.InstitutionID) || toAdmin {
+			continue
+		}
+		role := groupRole(syncSetup, person, schulmitgliedschaften, school)
+		resp, err := syncSetup.itsl.CreateMembership(ctx, group, person.PersonSyncKey, role)
+		if err != nil {
+			rollover.Errors++
+			transitionPerson(ctx, syncSetup, person, eventFailed, errors.New(resp))
+			return
+		}
+		trail.addMembership(group, role)
+	}
+	transitionPerson(ctx, syncSetup, person, eventSucceeded, nil)
+}
+
+// previousGroups sind die Gruppen, in denen der Crawler die Person laut Audit zurzeit hält, ohne ihre Schulen.
+// Ohne Audit-Eintrag ist der alte Stand unbekannt und es wird nil geliefert.
+func previousGroups(db *gorm.DB, personSyncKey string, schulmitgliedschaften map[string]string) map[string]bool {
+	memberships, err := currentMemberships(db, personSyncKey)
+	if err != nil {
+		log.Println("Rollover", personSyncKey, err)
+		return nil
+	}
+	if len(memberships) == 0 {
+		return nil
+	}
+	groups := make(map[string]bool)
+	for _, membership := range memberships {
+		i := strings.LastIndex(membership, ":")
+		if i < 0 {
+			continue
+		}
+		group := membership[:i]
+		if _, ok := schulmitgliedschaften[group]; !ok {
+			groups[group] = true
+		}
+	}
+	return groups
+}
+
+// rolloverCommand verwaltet den Schuljahreswechsel:
+// ucs_crawler rollover map -institution id (-old gruppe -new gruppe [-school schule] | -file zuordnung.csv)
+// ucs_crawler rollover list -institution id
+// ucs_crawler rollover clear -institution id
+// ucs_crawler rollover run -institution id -by name [-dry-run]
+// Die CSV-Datei enthält je Zeile alte Gruppe, neue Gruppe und optional die Schule.
+func rolloverCommand(ctx context.Context, allDatabases map[string]*gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rollover map|list|clear|run")
+	}
+	flags := flag.NewFlagSet("rollover", flag.ExitOnError)
+	institutionID := flags.Uint("institution", 0, "institution")
+	oldGroup := flags.String("old", "", "group of the old school year")
+	newGroup := flags.String("new", "", "group of the new school year")
+	school := flags.String("school", "", "school of the groups, default: parent of the old group")
+	file := flags.String("file", "", "CSV file with old group, new group and optional school per line")
+	by := flags.String("by", "", "who runs the rollover")
+	dryRun := flags.Bool("dry-run", false, "only count what would be done")
+	flags.Parse(args[1:])
+
+	db := allDatabases[strconv.Itoa(int(*institutionID))]
+	if *institutionID == 0 || db == nil {
+		return errors.New("unknown institution " + strconv.Itoa(int(*institutionID)))
+	}
+	err := migrateInstitutionDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "map":
+		rows := [][]string{{*oldGroup, *newGroup, *school}}
+		if *file != "" {
+			rows, err = readRolloverFile(*file)
+			if err != nil {
+				return err
+			}
+		}
+		for _, row := range rows {
+			err = addRolloverMapping(db, row)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("institution %d: %d mappings added, updates are held until 'rollover run'\n", *institutionID, len(rows))
+		return nil
+	case "list":
+		var mappings []UcsRolloverMapping
+		err = db.Where("done = ?", false).Order("old_sync_id").Find(&mappings).Error
+		if err != nil {
+			return err
+		}
+		for _, mapping := range mappings {
+			fmt.Printf("open: %s -> %s (%s)\n", mapping.OldSyncID, mapping.NewSyncID, mapping.School)
+		}
+		var rollovers []UcsRollover
+		err = db.Order("id desc").Limit(10).Find(&rollovers).Error
+		if err != nil {
+			return err
+		}
+		for _, r := range rollovers {
+			fmt.Printf("#%d %s by %s: mappings=%d persons=%d memberships=%d remaining=%d errors=%d\n",
+				r.ID, r.CreatedAt.Format(time.RFC3339), r.StartedBy, r.Mappings, r.Persons, r.Memberships, r.Remaining, r.Errors)
+		}
+		return nil
+	case "clear":
+		result := db.Unscoped().Where("done = ?", false).Delete(&UcsRolloverMapping{})
+		if result.Error != nil {
+			return result.Error
+		}
+		fmt.Printf("institution %d: %d open mappings removed\n", *institutionID, result.RowsAffected)
+		return nil
+	case "run":
+		if *by == "" {
+			return errors.New("parameter by is missing")
+		}
+		return rolloverInstitution(ctx, allDatabases, *institutionID, *by, *dryRun)
+	}
+	return errors.New("unknown rollover command " + args[0])
+}
+
+func readRolloverFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(row) < 3 {
+			row = append(row, "")
+		}
+		rows = append(rows, row)
+	}
+}
+
+func addRolloverMapping(db *gorm.DB, row []string) error {
+	mapping := UcsRolloverMapping{
+		OldSyncID: strings.TrimSpace(row[0]),
+		NewSyncID: strings.TrimSpace(row[1]),
+		School:    strings.TrimSpace(row[2]),
+	}
+	if mapping.OldSyncID == "" || mapping.NewSyncID == "" {
+		return errors.New("old and new group are needed")
+	}
+	if mapping.School == "" {
+		var group UcsCreatedGroup
+		err := db.Where("sync_id = ?", mapping.OldSyncID).Last(&group).Error
+		if err != nil {
+			return errors.New("school of " + mapping.OldSyncID + " is unknown, please set it")
+		}
+		mapping.School = group.ParentSyncID
+	}
+	return db.Save(&mapping).Error
+}
+
+// rolloverInstitution führt den Wechsel unter der Sperre der Institution aus, damit kein Lauf gleichzeitig arbeitet.
+func rolloverInstitution(ctx context.Context, allDatabases map[string]*gorm.DB, institutionID uint, by string, dryRun bool) error {
+	setup, err := loadSyncSetup(allDatabases, institutionID)
+	if err != nil {
+		return err
+	}
+	leases, err := acquireLeases(allDatabases["Client"], map[uint]ucsSyncSetup{institutionID: setup})
+	if err != nil {
+		return err
+	}
+	defer leases.release()
+	if !leases.holds(institutionID) {
+		return errors.New("another instance holds the lease")
+	}
+	ctx, cancel := leases.context(ctx, institutionID)
+	defer cancel()
+
+	rollover := UcsRollover{
+		RunID:     "rollover-" + strconv.FormatInt(time.Now().Unix(), 10),
+		StartedBy: by,
+		DryRun:    dryRun,
+	}
+	err = runRollover(withRunID(ctx, rollover.RunID), setup, &rollover)
+	now := time.Now()
+	rollover.FinishedAt = &now
+
+	summary := fmt.Sprintf("Rollover institution %d by %s: dry-run=%t mappings=%d persons=%d memberships=%d remaining=%d errors=%d",
+		institutionID, by, dryRun, rollover.Mappings, rollover.Persons, rollover.Memberships, rollover.Remaining, rollover.Errors)
+	if err != nil {
+		summary = summary + " stopped: " + err.Error()
+	}
+	fmt.Println(summary)
+	if !dryRun {
+		sendLog(summary)
+		if serr := setup.Store.save(&rollover); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// version wird beim Bauen gesetzt: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// Ergebnisse einer Person in einem Lauf.
+const (
+	outcomeImported    = "imported"
+	outcomeUpdated     = "updated"
+	outcomeDeleted     = "deleted"
+	outcomeDeactivated = "deactivated" // in der Schonfrist vor der Löschung
+	outcomeSkipped     = "skipped"
+	outcomeFailed      = "failed"
+	outcomeInterrupted = "interrupted" // abgebrochen, wird im nächsten Lauf wiederholt
+)
+
+// topErrorCount ist die Anzahl der häufigsten Fehler, die je Institution gespeichert werden.
+const topErrorCount = 5
+
+// CrawlerRun ist die Zusammenfassung eines Laufs in der Client Datenbank.
+type CrawlerRun struct {
+	gorm.Model
+	RunUUID     string `gorm:"index"` // RunID der UcsAuditEntry Einträge
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Host        string
+	Version     string
+	Imported    int
+	Updated     int
+	Deleted     int
+	Deactivated int
+	Skipped     int
+	Failed      int
+	Interrupted int
+}
+
+// CrawlerRunInstitution sind die Zahlen einer Institution in einem Lauf.
+type CrawlerRunInstitution struct {
+	gorm.Model
+	CrawlerRunID    uint
+	InstitutionID   uint
+	Imported        int
+	Updated         int
+	Deleted         int
+	Deactivated     int
+	Skipped         int
+	Failed          int
+	Interrupted     int
+	TopErrors       string `sql:"type:text"` // JSON Fehlertext -> Anzahl
+	DurationSeconds float64
+}
+
+type institutionReport struct {
+	outcomes map[string]int
+	errors   map[string]int
+	duration time.Duration
+}
+
+type runReport struct {
+	mu           sync.Mutex
+	run          CrawlerRun
+	institutions map[uint]*institutionReport
+}
+
+type runReportKey struct{}
+
+// withRunReport hängt den Bericht des Laufs an den Kontext. Alle Personen des Laufs zählen in diesen Bericht.
+func withRunReport(ctx context.Context, report *runReport) context.Context {
+	return context.WithValue(withRunID(ctx, report.id()), runReportKey{}, report)
+}
+
+// runReportOf liefert den Bericht des Laufs oder nil, z.B. für eine einzelne Person über die Admin-API.
+func runReportOf(ctx context.Context) *runReport {
+	report, _ := ctx.Value(runReportKey{}).(*runReport)
+	return report
+}
+
+func newRunReport(start time.Time) *runReport {
+	host, _ := os.Hostname()
+	return &runReport{
+		run: CrawlerRun{
+			RunUUID:   uuid.New().String(),
+			StartedAt: start,
+			Host:      host,
+			Version:   version,
+		},
+		institutions: make(map[uint]*institutionReport),
+	}
+}
+
+func (r *runReport) id() string {
+	return r.run.RunUUID
+}
+
+func (r *runReport) institution(institutionID uint) *institutionReport {
+	report, ok := r.institutions[institutionID]
+	if !ok {
+		report = &institutionReport{
+			outcomes: make(map[string]int),
+			errors:   make(map[string]int),
+		}
+		r.institutions[institutionID] = report
+	}
+	return report
+}
+
+// record zählt das Ergebnis einer Person. Ohne laufenden Lauf wird nur die Metrik gezählt.
+func (r *runReport) record(institutionID uint, action, outcome string, err error) {
+	personsProcessed.WithLabelValues(strconv.Itoa(int(institutionID)), action, outcome).Inc()
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.institution(institutionID)
+	report.outcomes[outcome]++
+	if err != nil {
+		report.errors[err.Error()]++
+	}
+}
+
+func (r *runReport) addDuration(institutionID uint, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.institution(institutionID).duration += d
+}
+
+func topErrors(errors map[string]int) map[string]int {
+	var texts []string
+	for text := range errors {
+		texts = append(texts, text)
+	}
+	sort.Slice(texts, func(i, j int) bool {
+		if errors[texts[i]] != errors[texts[j]] {
+			return errors[texts[i]] > errors[texts[j]]
+		}
+		return texts[i] < texts[j]
+	})
+	top := make(map[string]int)
+	for i := 0; i < len(texts) && i < topErrorCount; i++ {
+		top[texts[i]] = errors[texts[i]]
+	}
+	return top
+}
+
+// save schreibt den Lauf mit allen Institutionen in die Client Datenbank.
+func (r *runReport) save(dbClient *gorm.DB, finished time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.run.FinishedAt = finished
+	var institutions []CrawlerRunInstitution
+	for institutionID, report := range r.institutions {
+		b, _ := json.Marshal(topErrors(report.errors))
+		institution := CrawlerRunInstitution{
+			InstitutionID:   institutionID,
+			Imported:        report.outcomes[outcomeImported],
+			Updated:         report.outcomes[outcomeUpdated],
+			Deleted:         report.outcomes[outcomeDeleted],
+			Deactivated:     report.outcomes[outcomeDeactivated],
+			Skipped:         report.outcomes[outcomeSkipped],
+			Failed:          report.outcomes[outcomeFailed],
+			Interrupted:     report.outcomes[outcomeInterrupted],
+			TopErrors:       string(b),
+			DurationSeconds: report.duration.Seconds(),
+		}
+		r.run.Imported += institution.Imported
+		r.run.Updated += institution.Updated
+		r.run.Deleted += institution.Deleted
+		r.run.Deactivated += institution.Deactivated
+		r.run.Skipped += institution.Skipped
+		r.run.Failed += institution.Failed
+		r.run.Interrupted += institution.Interrupted
+		institutions = append(institutions, institution)
+	}
+
+	err := dbClient.Save(&r.run).Error
+	if err != nil {
+		return err
+	}
+	for _, institution := range institutions {
+		institution.CrawlerRunID = r.run.ID
+		err = dbClient.Save(&institution).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runsCommand zeigt die letzten Läufe: ucs_crawler runs [-limit n] [-institution id]
+func runsCommand(allDatabases map[string]*gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("runs", flag.ExitOnError)
+	limit := flags.Int("limit", 20, "number of runs")
+	institutionID := flags.Uint("institution", 0, "show only this institution")
+	flags.Parse(args)
+
+	var runs []CrawlerRun
+	err := allDatabases["Client"].Order("started_at desc").Limit(*limit).Find(&runs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		fmt.Printf("#%d %s %s - %s host=%s version=%s imported=%d updated=%d deleted=%d deactivated=%d skipped=%d failed=%d interrupted=%d\n",
+			run.ID, run.RunUUID, run.StartedAt.Format(time.RFC3339), run.FinishedAt.Format(time.RFC3339), run.Host, run.Version,
+			run.Imported, run.Updated, run.Deleted, run.Deactivated, run.Skipped, run.Failed, run.Interrupted)
+
+		var institutions []CrawlerRunInstitution
+		query := allDatabases["Client"].Where("crawler_run_id = ?", run.ID)
+		if *institutionID != 0 {
+			query = query.Where("institution_id = ?", *institutionID)
+		}
+		err = query.Order("institution_id").Find(&institutions).Error
+		if err != nil {
+			return err
+		}
+		for _, institution := range institutions {
+			fmt.Printf("    institution %d: imported=%d updated=%d deleted=%d deactivated=%d skipped=%d failed=%d interrupted=%d duration=%.1fs errors=%s\n",
+				institution.InstitutionID, institution.Imported, institution.Updated, institution.Deleted, institution.Deactivated,
+				institution.Skipped, institution.Failed, institution.Interrupted, institution.DurationSeconds, institution.TopErrors)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"github.com/itslearninggermany/itswizard_basic"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phasen eines Laufs.
+const (
+	phaseImport = "import"
+	phaseDelete = "delete"
+	phaseUpdate = "update"
+)
+
+// unlimitedQuota hebt die Begrenzung einer Phase auf.
+const unlimitedQuota = -1
+
+const (
+	defaultPhaseOrder = phaseImport + "," + phaseDelete + "," + phaseUpdate
+	defaultPageSize   = 50
+)
+
+// defaultQuotas gelten, wenn für die Institution keine Quote hinterlegt ist.
+var defaultQuotas = map[string]int{
+	phaseImport: unlimitedQuota,
+	phaseDelete: 500,
+	phaseUpdate: 200,
+}
+
+var phaseQueries = map[string]string{
+	phaseImport: "to_import = 1 and error = 0 and (to_delete = 0 or success = 1)",
+	phaseDelete: "to_delete = 1 and success = 0 and error = 0",
+	phaseUpdate: "to_update = 1 and error = 0 and (to_delete = 0 or success = 1)",
+}
+
+type phaseWork struct {
+	phase     string
+	quota     int
+	processed int
+	seen      map[uint]bool
+	done      bool
+}
+
+type institutionWork struct {
+	institutionID uint
+	setup         ucsSyncSetup
+	ctx           context.Context // endet mit dem Lauf oder dem Verlust der Sperre
+	priority      int
+	phases        []*phaseWork
+	next          int
+	deletesHeld   bool // Löschbremse angezogen, nur freigegebene Löschungen laufen
+}
+
+// newInstitutionWork liest Reihenfolge, Quoten und Priorität der Institution aus dem UniventionCrawlerSetup.
+func newInstitutionWork(institutionID uint, setup ucsSyncSetup) *institutionWork {
+	work := &institutionWork{
+		institutionID: institutionID,
+		setup:         setup,
+		priority:      setup.CrawlerSetup.Priority,
+	}
+	if work.priority < 1 {
+		work.priority = 1
+	}
+
+	quotas := map[string]int{
+		phaseImport: setup.CrawlerSetup.ImportQuota,
+		phaseDelete: setup.CrawlerSetup.DeleteQuota,
+		phaseUpdate: setup.CrawlerSetup.UpdateQuota,
+	}
+
+	order := setup.CrawlerSetup.PhaseOrder
+	if order == "" {
+		order = defaultPhaseOrder
+	}
+	added := make(map[string]bool)
+	for _, phase := range append(strings.Split(order, ","), strings.Split(defaultPhaseOrder, ",")...) {
+		phase = strings.TrimSpace(phase)
+		if _, ok := phaseQueries[phase]; !ok || added[phase] {
+			continue
+		}
+		added[phase] = true
+		quota := quotas[phase]
+		if quota == 0 {
+			quota = defaultQuotas[phase]
+		}
+		work.phases = append(work.phases, &phaseWork{
+			phase: phase,
+			quota: quota,
+			seen:  make(map[uint]bool),
+		})
+	}
+	return work
+}
+
+func (w *institutionWork) pageSize() int {
+	if w.setup.CrawlerSetup.PageSize > 0 {
+		return w.setup.CrawlerSetup.PageSize
+	}
+	return defaultPageSize
+}
+
+func (w *institutionWork) phase(name string) *phaseWork {
+	for _, phase := range w.phases {
+		if phase.phase == name {
+			return phase
+		}
+	}
+	return nil
+}
+
+func (w *institutionWork) finished() bool {
+	for _, phase := range w.phases {
+		if !phase.done {
+			return false
+		}
+	}
+	return true
+}
+
+// nextPhase wechselt reihum zwischen den offenen Phasen, beginnend mit der ersten der Reihenfolge.
+func (w *institutionWork) nextPhase() *phaseWork {
+	for i := 0; i < len(w.phases); i++ {
+		phase := w.phases[(w.next+i)%len(w.phases)]
+		if !phase.done {
+			w.next = (w.next + i + 1) % len(w.phases)
+			return phase
+		}
+	}
+	return nil
+}
+
+// runScheduler verteilt die Arbeit seitenweise auf alle Institutionen und Phasen.
+// Institutionen mit höherer Priorität bekommen je Runde entsprechend mehr Seiten.
+// Es werden nur Personen bearbeitet, die vor dem Start des Laufs geändert wurden.
+// Institutionen, deren Sperre verloren geht, werden nicht weiter bearbeitet.
+func runScheduler(ctx context.Context, ucsSyncSetupMap map[uint]ucsSyncSetup, runStart time.Time, leases *leaseSet) {
+	var works []*institutionWork
+	for institutionID, setup := range ucsSyncSetupMap {
+		work := newInstitutionWork(institutionID, setup)
+		var cancel context.CancelFunc
+		work.ctx, cancel = leases.context(ctx, institutionID)
+		defer cancel()
+		if work.ctx.Err() == nil {
+			held, err := checkDeleteBrake(work.ctx, setup, runStart)
+			if err != nil {
+				work.phase(phaseDelete).done = true
+			}
+			work.deletesHeld = held
+		}
+		if work.ctx.Err() == nil && rolloverPending(setup) {
+			log.Println("Updates of institution", institutionID, "are held until the rollover has run")
+			work.phase(phaseUpdate).done = true
+		}
+		works = append(works, work)
+	}
+	sort.Slice(works, func(i, j int) bool {
+		if works[i].priority != works[j].priority {
+			return works[i].priority > works[j].priority
+		}
+		return works[i].institutionID < works[j].institutionID
+	})
+
+	for _, work := range works {
+		updateQueueDepth(work.institutionID, work.setup.db)
+	}
+	defer func() {
+		for _, work := range works {
+			updateQueueDepth(work.institutionID, work.setup.db)
+		}
+	}()
+
+	for {
+		active := false
+		for _, work := range works {
+			if !work.finished() && work.ctx.Err() != nil {
+				if ctx.Err() == nil {
+					sendLog("No lease for institution " + strconv.Itoa(int(work.institutionID)) + ", skip it")
+				}
+				for _, phase := range work.phases {
+					phase.done = true
+				}
+			}
+			if !work.finished() && !work.setup.Store.healthy() {
+				sendLog("Database of institution " + strconv.Itoa(int(work.institutionID)) + " is not writable, stop institution")
+				for _, phase := range work.phases {
+					phase.done = true
+				}
+			}
+			for i := 0; i < work.priority && !work.finished(); i++ {
+				active = true
+				processPage(work, work.nextPhase(), runStart)
+			}
+		}
+		if !active {
+			return
+		}
+	}
+}
+
+// processPage bearbeitet eine Seite einer Phase, sortiert nach updated_at.
+func processPage(work *institutionWork, phase *phaseWork, runStart time.Time) {
+	limit := work.pageSize()
+	if phase.quota != unlimitedQuota && phase.quota-phase.processed < limit {
+		limit = phase.quota - phase.processed
+	}
+	if limit <= 0 {
+		phase.done = true
+		return
+	}
+
+	var persons []itswizard_basic.UniventionPerson
+	query := work.setup.db.Where(phaseQueries[phase.phase]+" and data <> '' and updated_at < ?", runStart.Truncate(time.Second))
+	if phase.phase == phaseDelete {
+		query = excludePendingApprovals(excludeGracePeriod(query, work.setup.CrawlerSetup), work.setup.CrawlerSetup)
+		if work.deletesHeld {
+			query = onlyReleasedDeletions(query)
+		}
+	}
+	err := query.Order("updated_at, id").Limit(limit).Find(&persons).Error
+	if err != nil && err.Error() != "record not found" {
+		sendLog("Error while getting UniventionPerson to " + phase.phase + " of institution " + strconv.Itoa(int(work.institutionID)) + ": " + err.Error() + " Stop institution")
+		log.Println(err)
+		for _, p := range work.phases {
+			p.done = true
+		}
+		return
+	}
+
+	var page []itswizard_basic.UniventionPerson
+	unseen := 0
+	for _, person := range persons {
+		if !phase.seen[person.ID] {
+			phase.seen[person.ID] = true
+			unseen++
+			// Personen, die gerade über die Admin-API bearbeitet werden, kommen im nächsten Lauf dran.
+			if !lockUser(person.PersonSyncKey) {
+				continue
+			}
+			page = append(page, person)
+		}
+	}
+	defer func() {
+		for _, person := range page {
+			unlockUser(person.PersonSyncKey)
+		}
+	}()
+	// Personen, die trotz Bearbeitung wieder geliefert werden, würden die Phase endlos blockieren.
+	if unseen == 0 {
+		phase.done = true
+		return
+	}
+	phase.processed += len(page)
+	if len(persons) < limit {
+		phase.done = true
+	}
+
+	currentHeartbeat.setPhase(phase.phase, work.institutionID)
+	start := time.Now()
+	defer func() {
+		runReportOf(work.ctx).addDuration(work.institutionID, time.Since(start))
+	}()
+
+	// Nach einem Abbruch oder wenn die Datenbank nicht mehr schreibbar ist, werden keine weiteren Personen
+	// begonnen. Sie bleiben für den nächsten Lauf markiert.
+	switch phase.phase {
+	case phaseImport:
+		for _, person := range page {
+			if work.ctx.Err() != nil || !work.setup.Store.healthy() {
+				return
+			}
+			ctx, cancel := context.WithTimeout(work.ctx, work.setup.CrawlerSetup.personTimeout())
+			sendLog(ucsImportUser(ctx, work.setup, person, work.institutionID))
+			cancel()
+		}
+	case phaseDelete:
+		for _, person := range page {
+			if work.ctx.Err() != nil || !work.setup.Store.healthy() {
+				return
+			}
+			ctx, cancel := context.WithTimeout(work.ctx, work.setup.CrawlerSetup.personTimeout())
+			sendLog(ucsDeleteUser(ctx, work.setup, person, work.institutionID))
+			cancel()
+		}
+	case phaseUpdate:
+		var ch = make(chan string, len(page))
+		started := 0
+		for _, person := range page {
+			if work.ctx.Err() != nil || !work.setup.Store.healthy() {
+				break
+			}
+			log.Println("Update")
+			started++
+			go func(person itswizard_basic.UniventionPerson) {
+				ctx, cancel := context.WithTimeout(work.ctx, work.setup.CrawlerSetup.personTimeout())
+				defer cancel()
+				ucsUpdateUser(ctx, work.setup, person, work.institutionID, ch)
+			}(person)
+		}
+		for i := 0; i < started; i++ {
+			sendLog(<-ch)
+		}
+	}
+}
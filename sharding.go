@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// shardVirtualNodes ist die Anzahl der Punkte je Instanz auf dem Hash-Ring.
+const shardVirtualNodes = 100
+
+// instanceTimeout ist die Zeit ohne Heartbeat, nach der eine Instanz als ausgefallen gilt.
+const instanceTimeout = 3 * heartbeatInterval
+
+// CrawlerAssignment weist eine Institution fest einer Instanz zu.
+// Läuft die Instanz nicht, wird die Institution über den Hash-Ring verteilt.
+type CrawlerAssignment struct {
+	gorm.Model
+	InstitutionID uint `gorm:"unique_index"`
+	InstanceID    string
+}
+
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func shardHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(instances []string) hashRing {
+	ring := hashRing{owners: make(map[uint32]string)}
+	for _, instance := range instances {
+		for i := 0; i < shardVirtualNodes; i++ {
+			point := shardHash(instance + "#" + strconv.Itoa(i))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = instance
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner liefert die Instanz mit dem nächsten Punkt im Uhrzeigersinn.
+func (r hashRing) owner(institutionID uint) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := shardHash("institution-" + strconv.Itoa(int(institutionID)))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// aliveInstances sind alle Instanzen mit aktuellem Heartbeat und die eigene.
+func aliveInstances(dbClient *gorm.DB) ([]string, error) {
+	var services []RunningService
+	err := dbClient.Where("service_name = ? and last_heartbeat > NOW() - INTERVAL ? SECOND", serviceName, int(instanceTimeout/time.Second)).
+		Find(&services).Error
+	if err != nil && err.Error() != "record not found" {
+		return nil, err
+	}
+	alive := map[string]bool{instanceID(): true}
+	for _, service := range services {
+		if service.InstanceID != "" {
+			alive[service.InstanceID] = true
+		}
+	}
+	var instances []string
+	for instance := range alive {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	return instances, nil
+}
+
+// ownedInstitutions verteilt die Institutionen auf die laufenden Instanzen und liefert die eigenen.
+// Kommt eine Instanz hinzu oder fällt aus, ändert sich die Verteilung zum nächsten Lauf.
+func ownedInstitutions(dbClient *gorm.DB, institutionIDs []uint) ([]uint, error) {
+	instances, err := aliveInstances(dbClient)
+	if err != nil {
+		return nil, err
+	}
+	alive := make(map[string]bool)
+	for _, instance := range instances {
+		alive[instance] = true
+	}
+
+	var assignments []CrawlerAssignment
+	err = dbClient.Find(&assignments).Error
+	if err != nil && err.Error() != "record not found" {
+		return nil, err
+	}
+	assigned := make(map[uint]string)
+	for _, assignment := range assignments {
+		if alive[assignment.InstanceID] {
+			assigned[assignment.InstitutionID] = assignment.InstanceID
+		}
+	}
+
+	ring := newHashRing(instances)
+	self := instanceID()
+	var owned []uint
+	for _, institutionID := range institutionIDs {
+		owner, ok := assigned[institutionID]
+		if !ok {
+			owner = ring.owner(institutionID)
+		}
+		if owner == self {
+			owned = append(owned, institutionID)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i] < owned[j] })
+	return owned, nil
+}
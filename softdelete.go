@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+const (
+	defaultQuarantineGroup = "ucs-quarantine"
+	quarantineRole         = "Guest"
+	quarantineAction       = "Benutzerdeaktivierung"
+)
+
+// UcsSoftDelete ist eine Person, die in UCS gelöscht wurde und in der Schonfrist in der Quarantänegruppe liegt.
+// Die Person bleibt mit ihren Daten in itslearning und wird erst nach DeleteGraceDays gelöscht.
+// Taucht sie vorher in UCS wieder auf, werden ihre Mitgliedschaften aus UCS wiederhergestellt.
+type UcsSoftDelete struct {
+	gorm.Model
+	PersonSyncKey string `gorm:"index"`
+	Username      string
+	DeactivatedAt time.Time
+	Restored      bool
+	RestoredAt    *time.Time
+	Deleted       bool // nach der Schonfrist in itslearning gelöscht
+}
+
+// deleteGrace ist die Schonfrist vor der Löschung, 0: sofort löschen.
+func (s UniventionCrawlerSetup) deleteGrace() time.Duration {
+	if s.DeleteGraceDays > 0 {
+		return time.Duration(s.DeleteGraceDays) * 24 * time.Hour
+	}
+	return 0
+}
+
+func (s UniventionCrawlerSetup) quarantineGroup() string {
+	if s.QuarantineGroupSyncID != "" {
+		return s.QuarantineGroupSyncID
+	}
+	return defaultQuarantineGroup
+}
+
+// activeSoftDelete liefert die offene Schonfrist einer Person oder nil.
+func activeSoftDelete(db *gorm.DB, personSyncKey string) (*UcsSoftDelete, error) {
+	var softDelete UcsSoftDelete
+	err := db.Where("person_sync_key = ? and restored = ? and deleted = ?", personSyncKey, false, false).Last(&softDelete).Error
+	if err != nil {
+		if err.Error() == "record not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &softDelete, nil
+}
+
+// excludeGracePeriod nimmt Personen in der Schonfrist aus der Löschphase. Nach Ablauf werden sie wieder gelesen und gelöscht.
+// Personen, die in der Schonfrist wieder in UCS vorhanden sind, werden gelesen, damit ucsDeleteUser sie zurückholt.
+func excludeGracePeriod(query *gorm.DB, setup UniventionCrawlerSetup) *gorm.DB {
+	grace := setup.deleteGrace()
+	if grace == 0 {
+		return query
+	}
+	return query.Where("(data not like ? or person_sync_key not in (select person_sync_key from ucs_soft_deletes "+
+		"where deleted_at is null and restored = 0 and deleted = 0 and deactivated_at > ?))", `%object": null,%`, time.Now().Add(-grace))
+}
+
+// removeMemberships löscht alle Mitgliedschaften einer Person in itslearning.
+// IMS-ES liefert nur die IDs der Mitgliedschaften, im Audit stehen deshalb Gruppe und Rolle aus den früheren Einträgen.
+func removeMemberships(ctx context.Context, syncSetup ucsSyncSetup, trail *auditTrail, personSyncKey string) (string, error) {
+	known, err := currentMemberships(syncSetup.db, personSyncKey)
+	if err != nil {
+		log.Println("Audit memberships", personSyncKey, err)
+	}
+	memberships, err := read(ctx, syncSetup.itsl, "ReadMembershipsForPerson", syncSetup.itsl.ReadMembershipsForPerson, personSyncKey)
+	if err != nil {
+		return err.Error(), err
+	}
+	for _, mem := range memberships {
+		id := mem.ID
+		resp, err := syncSetup.itsl.call(ctx, "DeleteMembership", func() (string, error) {
+			return syncSetup.itsl.DeleteMembership(id)
+		})
+		if err != nil {
+			return resp, err
+		}
+	}
+	if len(memberships) != len(known) {
+		log.Println("Person", personSyncKey, "had", len(memberships), "memberships in itslearning,", len(known), "created by the crawler")
+	}
+	trail.removeMemberships(known)
+	return "", nil
+}
+
+// quarantinePerson entfernt alle Mitgliedschaften der Person und nimmt sie in die Quarantänegruppe auf.
+// Das Konto und die Daten der Person bleiben in itslearning erhalten.
+func quarantinePerson(ctx context.Context, syncSetup ucsSyncSetup, trail *auditTrail, person itswizard_basic.UniventionPerson) (string, error) {
+	resp, err := removeMemberships(ctx, syncSetup, trail, person.PersonSyncKey)
+	if err != nil {
+		return resp, err
+	}
+	group := syncSetup.CrawlerSetup.quarantineGroup()
+	err = checkIfHierarchyNodeExist(ctx, syncSetup, group)
+	if err != nil {
+		return err.Error(), err
+	}
+	resp, err = syncSetup.itsl.CreateMembership(ctx, group, person.PersonSyncKey, quarantineRole)
+	if err != nil {
+		return resp, err
+	}
+	trail.addMembership(group, quarantineRole)
+
+	err = syncSetup.Store.save(&UcsSoftDelete{
+		PersonSyncKey: person.PersonSyncKey,
+		Username:      person.Username,
+		DeactivatedAt: time.Now(),
+	})
+	if err != nil {
+		return err.Error(), err
+	}
+	return "", nil
+}
+
+// restoreSoftDelete beendet die Schonfrist einer Person, die wieder in UCS vorhanden ist.
+func restoreSoftDelete(syncSetup ucsSyncSetup, softDelete *UcsSoftDelete) {
+	now := time.Now()
+	softDelete.Restored = true
+	softDelete.RestoredAt = &now
+	if err := syncSetup.Store.save(softDelete); err == nil {
+		sendLog("Person " + softDelete.Username + " (" + softDelete.PersonSyncKey + ") was restored from quarantine")
+	}
+}
+
+// finishSoftDelete vermerkt die Löschung nach der Schonfrist.
+func finishSoftDelete(syncSetup ucsSyncSetup, softDelete *UcsSoftDelete) {
+	softDelete.Deleted = true
+	syncSetup.Store.save(softDelete)
+}
+
+// expireGracePeriod lässt die Schonfrist einer Person sofort ablaufen. Eine Person, die schon gelöscht wurde,
+// aber noch in itslearning vorhanden ist, wird so ohne erneute Quarantäne und Freigabe gelöscht.
+func expireGracePeriod(syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson) error {
+	grace := syncSetup.CrawlerSetup.deleteGrace()
+	if grace == 0 {
+		return nil
+	}
+	softDelete, err := activeSoftDelete(syncSetup.db, person.PersonSyncKey)
+	if err != nil {
+		return err
+	}
+	if softDelete == nil {
+		softDelete = &UcsSoftDelete{PersonSyncKey: person.PersonSyncKey, Username: person.Username}
+	}
+	softDelete.DeactivatedAt = time.Now().Add(-grace)
+	return syncSetup.Store.save(softDelete)
+}
+
+// checkGracePeriod liefert einen Fehler, solange die Schonfrist der Person läuft.
+func checkGracePeriod(syncSetup ucsSyncSetup, softDelete *UcsSoftDelete) error {
+	due := softDelete.DeactivatedAt.Add(syncSetup.CrawlerSetup.deleteGrace())
+	if time.Now().Before(due) {
+		return errors.New("person is in quarantine until " + due.Format(time.RFC3339))
+	}
+	return nil
+}
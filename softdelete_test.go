@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryRecorder ist eine Datenbank ohne Verbindung, die nur die letzte Abfrage festhält.
+type queryRecorder struct {
+	query string
+	args  []interface{}
+}
+
+var errNoDatabase = errors.New("no database")
+
+func (r *queryRecorder) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r.query, r.args = query, args
+	return nil, errNoDatabase
+}
+
+func (r *queryRecorder) Prepare(query string) (*sql.Stmt, error) {
+	return nil, errNoDatabase
+}
+
+func (r *queryRecorder) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	r.query, r.args = query, args
+	return nil, errNoDatabase
+}
+
+func (r *queryRecorder) QueryRow(query string, args ...interface{}) *sql.Row {
+	r.query, r.args = query, args
+	return nil
+}
+
+func TestExcludeGracePeriodLetsReturningPersonsThrough(t *testing.T) {
+	recorder := &queryRecorder{}
+	db, err := gorm.Open("mysql", recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup := UniventionCrawlerSetup{DeleteGraceDays: 30}
+	var persons []itswizard_basic.UniventionPerson
+	excludeGracePeriod(db.Where(phaseQueries[phaseDelete]), setup).Find(&persons)
+
+	if !strings.Contains(recorder.query, "(data not like ? or person_sync_key not in (select person_sync_key from ucs_soft_deletes") {
+		t.Fatalf("persons back in UCS are not let through the grace period: %s", recorder.query)
+	}
+	if len(recorder.args) != 2 {
+		t.Fatalf("got args %v, want the removal marker and the cutoff", recorder.args)
+	}
+	pattern, _ := recorder.args[0].(string)
+	marker := strings.Trim(pattern, "%")
+	returned := testPerson("student", `{}`)
+	returned.Data = `{"dn": "uid=test", "object": {"uid": "test"}, "options": {}}`
+	removed := testPerson("student", `{}`)
+	removed.Data = `{"dn": "uid=test", "object": null, "options": {}}`
+	if strings.Contains(returned.Data, marker) || !strings.Contains(removed.Data, marker) {
+		t.Errorf("pattern %q does not match the removal marker of ucsDeleteUser", pattern)
+	}
+	cutoff, _ := recorder.args[1].(time.Time)
+	if want := time.Now().Add(-30 * 24 * time.Hour); cutoff.Sub(want) > time.Minute || want.Sub(cutoff) > time.Minute {
+		t.Errorf("got cutoff %s, want %s", cutoff, want)
+	}
+}
+
+func TestExcludeGracePeriodWithoutGrace(t *testing.T) {
+	recorder := &queryRecorder{}
+	db, err := gorm.Open("mysql", recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persons []itswizard_basic.UniventionPerson
+	excludeGracePeriod(db.Where(phaseQueries[phaseDelete]), UniventionCrawlerSetup{}).Find(&persons)
+	if strings.Contains(recorder.query, "ucs_soft_deletes") {
+		t.Errorf("grace period filter without DeleteGraceDays: %s", recorder.query)
+	}
+}
+
+// Eine Person in der Quarantäne, die wieder in UCS vorhanden ist, wird aus der Löschphase als vollständiges Update
+// weitergegeben. ucsUpdateUser ersetzt dann die Quarantänegruppe und beendet die Schonfrist mit restoreSoftDelete.
+func TestRestoreInGracePeriod(t *testing.T) {
+	person := testPerson("student", `{"schoolA": "student"}`)
+	person.ToDelete = true
+	person.Data = `{"dn": "uid=test", "object": {"uid": "test"}, "options": {}}`
+
+	from := syncStateOf(person)
+	if from != stateToDelete || phaseOf(from) != phaseDelete {
+		t.Fatalf("quarantined person is in state %s, want %s in the delete phase", from, stateToDelete)
+	}
+	to, ok := personTransitions[from][eventPresent]
+	if !ok || to != stateToUpdate {
+		t.Fatalf("present person goes to %q, want %s", to, stateToUpdate)
+	}
+	setPersonState(&person, to, "")
+	if syncStateOf(person) != stateToUpdate || phaseOf(stateToUpdate) != phaseUpdate {
+		t.Errorf("restored person is in state %s, want %s", syncStateOf(person), stateToUpdate)
+	}
+	if !person.UpdateSchulmitgliedschaften || !person.UpdateGruppenMitgliedschaften {
+		t.Error("restored person does not get its memberships back")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"github.com/itslearninggermany/itswizard_basic"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// personSyncState ist der Zustand einer Person, abgeleitet aus ihren Spalten.
+type personSyncState string
+
+const (
+	stateToImport     personSyncState = "to_import"
+	stateImportFailed personSyncState = "import_failed"
+	stateToUpdate     personSyncState = "to_update"
+	stateUpdateFailed personSyncState = "update_failed"
+	stateToDelete     personSyncState = "to_delete"
+	stateDeleteFailed personSyncState = "delete_failed"
+	stateDeleted      personSyncState = "deleted"
+	stateSynced       personSyncState = "synced"
+)
+
+// personEvent ist das Ergebnis der Bearbeitung einer Person.
+type personEvent string
+
+const (
+	eventSucceeded   personEvent = "succeeded"   // in itslearning übertragen
+	eventSkipped     personEvent = "skipped"     // nicht zu übertragen, z.B. wegen OU Auswahl
+	eventFailed      personEvent = "failed"      // Fehler bei der Übertragung
+	eventRemoved     personEvent = "removed"     // in UCS gelöscht, statt Import oder Update wird gelöscht
+	eventPresent     personEvent = "present"     // in UCS vorhanden, statt Löschung wird aktualisiert
+	eventQuarantined personEvent = "quarantined" // in die Quarantänegruppe verschoben, wird nach der Schonfrist gelöscht
+	eventRejected    personEvent = "rejected"    // Löschung bei der Freigabe abgelehnt, die Person bleibt in itslearning
+)
+
+var (
+	importTransitions = map[personEvent]personSyncState{
+		eventSucceeded: stateSynced,
+		eventSkipped:   stateSynced,
+		eventFailed:    stateImportFailed,
+		eventRemoved:   stateToDelete,
+	}
+	updateTransitions = map[personEvent]personSyncState{
+		eventSucceeded: stateSynced,
+		eventSkipped:   stateSynced,
+		eventFailed:    stateUpdateFailed,
+		eventRemoved:   stateToDelete,
+	}
+	deleteTransitions = map[personEvent]personSyncState{
+		eventSucceeded:   stateDeleted,
+		eventFailed:      stateDeleteFailed,
+		eventPresent:     stateToUpdate,
+		eventQuarantined: stateToDelete,
+		eventRejected:    stateSynced,
+	}
+)
+
+// personTransitions sind die erlaubten Übergänge. Aus synced und deleted führt erst eine Änderung
+// durch den UCS Listener wieder heraus.
+var personTransitions = map[personSyncState]map[personEvent]personSyncState{
+	stateToImport:     importTransitions,
+	stateImportFailed: importTransitions,
+	stateToUpdate:     updateTransitions,
+	stateUpdateFailed: updateTransitions,
+	stateToDelete:     deleteTransitions,
+	stateDeleteFailed: deleteTransitions,
+}
+
+// syncStateOf liest den Zustand aus den Spalten. Eine offene Löschung geht vor Import und Update,
+// sonst würde eine Person aus der Löschphase als Update behandelt und die Löschung ginge verloren.
+// Die Import- und Updatephase lassen Personen mit offener Löschung deshalb aus.
+func syncStateOf(person itswizard_basic.UniventionPerson) personSyncState {
+	switch {
+	case person.ToDelete && !person.Success && person.Error:
+		return stateDeleteFailed
+	case person.ToDelete && !person.Success:
+		return stateToDelete
+	case person.ToImport && person.Error:
+		return stateImportFailed
+	case person.ToImport:
+		return stateToImport
+	case person.ToUpdate && person.Error:
+		return stateUpdateFailed
+	case person.ToUpdate:
+		return stateToUpdate
+	case person.ToDelete:
+		return stateDeleted
+	}
+	return stateSynced
+}
+
+// phaseOf ist die Phase, in der eine Person mit diesem Zustand bearbeitet wird.
+func phaseOf(state personSyncState) string {
+	switch state {
+	case stateToImport, stateImportFailed:
+		return phaseImport
+	case stateToUpdate, stateUpdateFailed:
+		return phaseUpdate
+	}
+	return phaseDelete
+}
+
+// protocolActions sind die Aktionen im UcsProtokoll je Phase.
+var protocolActions = map[string]string{
+	phaseImport: "Benutzerimport",
+	phaseUpdate: "Benutzerupdate",
+	phaseDelete: "Benutzerlöschung",
+}
+
+var successOutcomes = map[string]string{
+	phaseImport: outcomeImported,
+	phaseUpdate: outcomeUpdated,
+	phaseDelete: outcomeDeleted,
+}
+
+// setPersonState setzt alle Spalten für einen Zustand. Bei update_failed bleiben die offenen Updates erhalten.
+func setPersonState(person *itswizard_basic.UniventionPerson, state personSyncState, errorstring string) {
+	keepUpdates := state == stateUpdateFailed
+
+	person.ToImport = state == stateImportFailed
+	person.ToUpdate = state == stateUpdateFailed || state == stateToUpdate
+	person.ToDelete = state == stateToDelete || state == stateDeleteFailed || state == stateDeleted
+	person.Success = state == stateSynced || state == stateDeleted
+	person.Error = state == stateImportFailed || state == stateUpdateFailed || state == stateDeleteFailed
+	person.Errorstring = ""
+	if person.Error {
+		person.Errorstring = errorstring
+	}
+	person.UpdateStammschule = false
+	person.UpdateDisable = false
+
+	update := state == stateToUpdate
+	person.UdpateFirstName = update || keepUpdates && person.UdpateFirstName
+	person.UdpateLastName = update || keepUpdates && person.UdpateLastName
+	person.UdpateUsername = update || keepUpdates && person.UdpateUsername
+	person.UdpateProfile = update || keepUpdates && person.UdpateProfile
+	person.UpdateEmail = update || keepUpdates && person.UpdateEmail
+	person.UpdateSchulmitgliedschaften = update || keepUpdates && person.UpdateSchulmitgliedschaften
+	person.UpdateGruppenMitgliedschaften = update || keepUpdates && person.UpdateGruppenMitgliedschaften
+}
+
+// transitionPerson führt eine Person mit dem Ergebnis ihrer Bearbeitung in den nächsten Zustand,
+// zählt das Ergebnis, schreibt das UcsProtokoll und speichert die Person.
+// Ungültige Übergänge werden abgelehnt und protokolliert, die Person bleibt dann unverändert.
+func transitionPerson(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, event personEvent, err error) error {
+	from := syncStateOf(person)
+	phase := phaseOf(from)
+	if event == eventFailed && ctx.Err() != nil {
+		err = ctx.Err()
+		errorstring := interruptedRetry
+		// Wurde ein schreibender Aufruf abgebrochen, ist unklar, was in itslearning angekommen ist.
+		// Die Person wird trotzdem wiederholt, Audit und Protokoll halten den offenen Aufruf fest.
+		if trail := auditTrailOf(ctx); trail != nil && trail.abandoned != "" {
+			err = errors.New(trail.abandoned + " was abandoned after " + ctx.Err().Error() + ", the result in itslearning is unknown")
+			errorstring = interruptedRetry + ": " + err.Error()
+		}
+		saveAudit(ctx, syncSetup, person, from, from, outcomeInterrupted, false, err)
+		saveInterruptedPerson(ctx, syncSetup, person, phase, protocolActions[phase], err, errorstring)
+		return nil
+	}
+
+	to, ok := personTransitions[from][event]
+	if !ok {
+		rejected := errors.New("invalid transition " + string(from) + " --" + string(event) + "--> for person " + person.PersonSyncKey)
+		log.Println(rejected)
+		sendLog(rejected.Error())
+		return rejected
+	}
+
+	var errorstring string
+	if err != nil {
+		errorstring = err.Error()
+	}
+	switch event {
+	case eventSucceeded:
+		runReportOf(ctx).record(syncSetup.InstitutionID, phase, successOutcomes[phase], nil)
+	case eventSkipped, eventRejected:
+		runReportOf(ctx).record(syncSetup.InstitutionID, phase, outcomeSkipped, nil)
+	case eventFailed:
+		runReportOf(ctx).record(syncSetup.InstitutionID, phase, outcomeFailed, err)
+	case eventQuarantined:
+		runReportOf(ctx).record(syncSetup.InstitutionID, phase, outcomeDeactivated, nil)
+	}
+	// Die Umleitung zwischen Löschung und Update ist noch kein Ergebnis und wird nicht protokolliert.
+	if event != eventRemoved && event != eventPresent {
+		action := protocolActions[phase]
+		switch event {
+		case eventQuarantined:
+			action = quarantineAction
+		case eventRejected:
+			action = action + " abgelehnt"
+		}
+		syncSetup.Store.save(&itswizard_basic.UcsProtokoll{
+			Username:    person.Username,
+			UUID:        person.PersonSyncKey,
+			Action:      action,
+			Success:     event != eventFailed,
+			Errorstring: errorstring,
+		})
+	}
+
+	saveAudit(ctx, syncSetup, person, from, to, string(event), event != eventFailed, err)
+
+	setPersonState(&person, to, errorstring)
+	return syncSetup.Store.savePerson(person)
+}
+
+// interruptedRetry steht im UcsProtokoll, wenn die Bearbeitung einer Person abgebrochen wurde.
+const interruptedRetry = "interrupted, retry"
+
+// saveInterruptedPerson protokolliert den Abbruch. Die Person bleibt unverändert und wird im nächsten Lauf erneut bearbeitet.
+func saveInterruptedPerson(ctx context.Context, syncSetup ucsSyncSetup, person itswizard_basic.UniventionPerson, phase, action string, err error, errorstring string) {
+	runReportOf(ctx).record(syncSetup.InstitutionID, phase, outcomeInterrupted, nil)
+	log.Println("Person", person.Username, "interrupted:", err)
+
+	syncSetup.Store.save(&itswizard_basic.UcsProtokoll{
+		Username:    person.Username,
+		UUID:        person.PersonSyncKey,
+		Action:      action,
+		Success:     false,
+		Errorstring: errorstring,
+	})
+}